@@ -25,7 +25,9 @@ func main() {
 
 	d.On(dog.Connected, func(e dog.Event) {
 		fmt.Println("Connected!")
-		d.JoinRoom("elysium", "DemoBot")
+		if err := d.JoinRoom("elysium", "DemoBot"); err != nil {
+			fmt.Println(err)
+		}
 	})
 
 	d.On(dog.RoomJoined, func(e dog.Event) {
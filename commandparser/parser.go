@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Cryptodog/go-cryptodog/dog"
 	"github.com/superp00t/etc"
 	"github.com/superp00t/etc/yo"
 )
@@ -21,9 +22,11 @@ type Handler struct {
 }
 
 type Parser struct {
-	Prefix                 rune
-	MaxLen                 int64
-	MaxSpamPerMinute       int64
+	Prefix           rune
+	MaxLen           int64
+	MaxSpamPerMinute int64
+	// Drives spam decay. Defaults to dog.SystemClock.
+	Clock                  dog.Clock
 	cmds                   map[string]*Handler
 	cl                     *sync.Mutex
 	AntiSpam               *sync.Map
@@ -115,7 +118,7 @@ func (p *Parser) Parse(room, from, data string) {
 	spm, ok := p.AntiSpam.Load(usID)
 	if !ok {
 		spa := &SpamData{
-			LastCommand: time.Now(),
+			LastCommand: p.clock().Now(),
 			SpamScore:   10,
 		}
 
@@ -123,7 +126,7 @@ func (p *Parser) Parse(room, from, data string) {
 
 		go func() {
 			for float64(spa.SpamScore) > 1 {
-				time.Sleep(40 * time.Second)
+				p.clock().Sleep(40 * time.Second)
 				spa.SpamScore = int64(
 					float64(spa.SpamScore) * .75,
 				)
@@ -134,11 +137,11 @@ func (p *Parser) Parse(room, from, data string) {
 	} else {
 		spa := spm.(*SpamData)
 
-		if time.Since(spa.LastCommand) < time.Minute && spa.SpamScore > p.MaxSpamPerMinute {
+		if p.clock().Now().Sub(spa.LastCommand) < time.Minute && spa.SpamScore > p.MaxSpamPerMinute {
 			return
 		}
 
-		spa.LastCommand = time.Now()
+		spa.LastCommand = p.clock().Now()
 
 		multiplier := int64(1)
 		if p.lastCommandString == data {
@@ -269,6 +272,14 @@ func New() *Parser {
 	return p
 }
 
+func (p *Parser) clock() dog.Clock {
+	if p.Clock != nil {
+		return p.Clock
+	}
+
+	return dog.SystemClock
+}
+
 func (p *Parser) Help() HelpCommands {
 	hc := HelpCommands{}
 	for k, v := range p.cmds {
@@ -3,6 +3,7 @@ package commandparser
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestParser(t *testing.T) {
@@ -14,3 +15,53 @@ func TestParser(t *testing.T) {
 
 	p.Parse("testzone", "tester", ".hello 6.9")
 }
+
+func TestNilClock(t *testing.T) {
+	p := New()
+	p.Clock = nil
+
+	// Falls back on the system clock.
+	p.Parse("testzone", "tester", "hi")
+}
+
+type stepClock struct {
+	now   time.Time
+	slept chan time.Duration
+	wake  chan struct{}
+}
+
+func (s *stepClock) Now() time.Time {
+	return s.now
+}
+
+func (s *stepClock) Sleep(d time.Duration) {
+	s.slept <- d
+	<-s.wake
+}
+
+func TestSpamDecay(t *testing.T) {
+	clk := &stepClock{time.Now(), make(chan time.Duration), make(chan struct{})}
+	p := New()
+	p.Clock = clk
+
+	p.Parse("testzone", "tester", "hi")
+
+	// A score of 10 decays by a quarter every 40 seconds until it reaches 1.
+	for i := 0; i < 5; i++ {
+		if d := <-clk.slept; d != 40*time.Second {
+			t.Fatal("unexpected decay period", d)
+		}
+		clk.wake <- struct{}{}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := p.AntiSpam.Load("tester@testzone"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spam score was not forgotten")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
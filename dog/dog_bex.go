@@ -2,7 +2,6 @@ package dog
 
 import (
 	"bytes"
-	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -53,6 +52,11 @@ const (
 	RTC_ANSWER            BEXHeader = 32
 	RTC_SIGNAL_CAPABILITY BEXHeader = 33
 	RTC_SIGNAL_DISABLED   BEXHeader = 34
+
+	// go-cryptodog extensions
+	TRANSCRIPT_HASH BEXHeader = 40
+	KEY_ROTATION    BEXHeader = 41
+	CONTINUATION    BEXHeader = 42
 )
 
 type BEX struct {
@@ -71,6 +75,10 @@ type BEX struct {
 	Level         uint64   `json:"level,omitempty"`
 	TableKey      string   `json:"tableKey,omitempty"`
 	Table         []string `json:"table,omitempty"`
+	Anchor        string   `json:"anchor,omitempty"`
+	Hashes        []string `json:"hashes,omitempty"`
+	PublicKey     []byte   `json:"publicKey,omitempty"`
+	Chunks        uint64   `json:"chunks,omitempty"`
 }
 
 func (b BEXHeader) String() string {
@@ -99,6 +107,12 @@ func (b BEXHeader) String() string {
 		return "got WebRTC answer"
 	case MOD_ELECTED:
 		return "mod subscription"
+	case TRANSCRIPT_HASH:
+		return "transcript checkpoint"
+	case KEY_ROTATION:
+		return "key rotation"
+	case CONTINUATION:
+		return "message continues"
 	}
 
 	return fmt.Sprintf("unknown BEX (%d)", b)
@@ -120,16 +134,48 @@ func ContainsBEXHeader(input []byte) bool {
 	return bytes.Equal(input[:3], BEX_MAGIC)
 }
 
-func DecodeBEX(input []byte) ([]BEX, error) {
-	e := etc.FromBytes(input)
-	var b []BEX
+// bexReader reads fields from a BEX packet, checking each length against what is left,
+// so that a truncated or lying packet ends decoding with an error rather than a panic or a huge allocation.
+type bexReader struct {
+	e   *etc.Buffer
+	bad bool
+}
+
+func (r *bexReader) need(n uint64) bool {
+	if r.bad || n > uint64(r.e.Available()) {
+		r.bad = true
+		return false
+	}
+	return true
+}
+
+func (r *bexReader) uint() uint64 {
+	if !r.need(1) {
+		return 0
+	}
+	return r.e.ReadUint()
+}
+
+func (r *bexReader) bytes(n uint64) []byte {
+	if !r.need(n) {
+		return nil
+	}
+	return r.e.ReadBytes(int(n))
+}
 
-	header := e.ReadBytes(3)
-	if !ContainsBEXHeader(header) {
+func (r *bexReader) string() string {
+	return string(r.bytes(r.uint()))
+}
+
+func DecodeBEX(input []byte) ([]BEX, error) {
+	if !ContainsBEXHeader(input) {
 		return nil, fmt.Errorf("phoxy: not a BEX message")
 	}
 
-	length := e.ReadUint()
+	e := &bexReader{e: etc.FromBytes(input[3:])}
+	var b []BEX
+
+	length := e.uint()
 
 	if length > 8 {
 		return nil, fmt.Errorf("phoxy: too many BEX submessages")
@@ -137,53 +183,77 @@ func DecodeBEX(input []byte) ([]BEX, error) {
 
 	for x := uint64(0); x < length; x++ {
 		bx := BEX{
-			Header: BEXHeader(e.ReadUint()),
+			Header: BEXHeader(e.uint()),
 		}
 
 		switch bx.Header {
 		case BEX_COMPOSING, BEX_PAUSED, FLAG_ME_AS_BOT, STATUS_AWAY, STATUS_ONLINE, REMOVE_DEAD_USERS:
 			// no body
 		case SET_COLOR:
-			bx.Color = fmt.Sprintf("#%X%X%X", e.ReadByte(), e.ReadByte(), e.ReadByte())
+			if c := e.bytes(3); c != nil {
+				bx.Color = fmt.Sprintf("#%02X%02X%02X", c[0], c[1], c[2])
+			}
 		case FILE_ATTACHMENT:
 			bx.File = new(File)
-			bx.File.PrefixSize = e.ReadUint()
-			bx.File.FileKey = e.ReadBoxKey()
-			bx.File.FileNonce = e.ReadBoxNonce()
-			bx.File.FileMIME = e.ReadUString()
-			bx.File.FileUUID = e.ReadUUID()
+			bx.File.PrefixSize = e.uint()
+			if e.need(32 + 24) {
+				bx.File.FileKey = e.e.ReadBoxKey()
+				bx.File.FileNonce = e.e.ReadBoxNonce()
+			}
+			bx.File.FileMIME = e.string()
+			if e.need(16) {
+				bx.File.FileUUID = e.e.ReadUUID()
+			}
 		case TEXT_MESSAGE:
-			bx.MessageType = e.ReadUString()
-			bx.Message = e.ReadUString()
+			bx.MessageType = e.string()
+			bx.Message = e.string()
 		case RTC_OFFER, RTC_ANSWER:
-			bx.Target = e.ReadUString()
-			bx.SDPData = e.ReadUString()
+			bx.Target = e.string()
+			bx.SDPData = e.string()
 		case ICE_CANDIDATE:
-			bx.Target = e.ReadUString()
-			bx.ICECandidate = e.ReadUString()
-			bx.SDPMLineIndex = e.ReadUint()
-			bx.SDPMid = e.ReadUString()
+			bx.Target = e.string()
+			bx.ICECandidate = e.string()
+			bx.SDPMLineIndex = e.uint()
+			bx.SDPMid = e.string()
 		case WHITELIST_USER:
-			bx.Target = e.ReadUString()
+			bx.Target = e.string()
 		case SET_LOCKDOWN_LEVEL:
-			bx.Level = e.ReadUint()
+			bx.Level = e.uint()
 		case SET_MODERATION_TABLE:
-			bx.TableKey = e.ReadUString()
-			ln := e.ReadUint()
+			bx.TableKey = e.string()
+			ln := e.uint()
 			if ln > 512 {
-				break
+				return nil, fmt.Errorf("phoxy: moderation table of %d entries is too long", ln)
 			}
 			bx.Table = make([]string, int(ln))
 			for x := range bx.Table {
-				bx.Table[x] = e.ReadUString()
+				bx.Table[x] = e.string()
 			}
 		case MOD_ELECTED:
-			bx.Target = e.ReadUString()
+			bx.Target = e.string()
+		case TRANSCRIPT_HASH:
+			bx.Anchor = e.string()
+			ln := e.uint()
+			if ln > maxTranscriptWindow {
+				return nil, fmt.Errorf("phoxy: transcript window of %d hashes is too long", ln)
+			}
+			bx.Hashes = make([]string, int(ln))
+			for x := range bx.Hashes {
+				bx.Hashes[x] = e.string()
+			}
+		case KEY_ROTATION:
+			bx.PublicKey = e.bytes(32)
+		case CONTINUATION:
+			bx.Chunks = e.uint()
 		default:
 			yo.L(4).Warn("received unknown bex type", bx.Header)
 			break
 		}
 
+		if e.bad {
+			return nil, fmt.Errorf("phoxy: truncated BEX message")
+		}
+
 		b = append(b, bx)
 	}
 
@@ -238,6 +308,16 @@ func EncodeBEX(b []BEX) []byte {
 			e.WriteUString(bx.Target)
 		case WHITELIST_USER:
 			e.WriteUString(bx.Target)
+		case TRANSCRIPT_HASH:
+			e.WriteUString(bx.Anchor)
+			e.WriteUint(uint64(len(bx.Hashes)))
+			for _, v := range bx.Hashes {
+				e.WriteUString(v)
+			}
+		case KEY_ROTATION:
+			e.Write(bx.PublicKey)
+		case CONTINUATION:
+			e.WriteUint(bx.Chunks)
 		}
 	}
 
@@ -330,6 +410,16 @@ func (r *Room) handleGroupBEXPacket(from string, data []byte) {
 			if r.IsMod(from) {
 				r.SetModerationTable(bx.TableKey, bx.Table)
 			}
+		case TRANSCRIPT_HASH:
+			if r.c.opt(TranscriptCheck) {
+				r.checkTranscript(from, bx.Anchor, bx.Hashes)
+			}
+		case KEY_ROTATION:
+			r.acceptRotation(from, bx.PublicKey)
+		case CONTINUATION:
+			if r.c.opt(Reassemble) {
+				r.expectLong(from, bx.Chunks)
+			}
 		}
 	}
 }
@@ -338,6 +428,10 @@ func (r *Room) SetModerationTable(tk string, tv []string) {
 	r.ModerationTables[tk] = tv
 	switch tk {
 	case "keys":
+		r.ml.Lock()
+		r.keyBans = fingerprintSet(tv)
+		r.ml.Unlock()
+
 		for _, v := range tv {
 			names := r.Mp.NamesByFingerprint(v)
 			for _, n := range names {
@@ -363,13 +457,11 @@ func (r *Room) IsBlocked(user string) bool {
 	}
 
 	fp := r.GroupFingerprint(user)
-	for _, v := range r.ModerationTables["keys"] {
-		if fp == v {
-			return true
-		}
-	}
+	r.ml.Lock()
+	_, banned := r.keyBans[fp]
+	r.ml.Unlock()
 
-	return false
+	return banned
 }
 
 func (r *Room) handlePrivateBEXPacket(from string, data []byte) {
@@ -451,8 +543,12 @@ func (r *Room) Upload(fileMime string, data []byte) (*File, error) {
 	fl.PrefixSize = etc.RandomBigInt(big.NewInt(4000), big.NewInt(14000)).Uint64()
 	fl.FileNonce = new([24]byte)
 	fl.FileKey = new([32]byte)
-	io.ReadFull(rand.Reader, fl.FileNonce[:])
-	io.ReadFull(rand.Reader, fl.FileKey[:])
+	if _, err := io.ReadFull(r.c.rand(), fl.FileNonce[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r.c.rand(), fl.FileKey[:]); err != nil {
+		return nil, err
+	}
 	fl.FileMIME = fileMime
 
 	dbuf := etc.NewBuffer()
@@ -0,0 +1,85 @@
+package dog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+)
+
+func FuzzDecodeBEX(f *testing.F) {
+	f.Add(EncodeBEX([]BEX{{Header: BEX_COMPOSING}, {Header: SET_COLOR, Color: "#FF00AA"}}))
+	f.Add(EncodeBEX([]BEX{{Header: TEXT_MESSAGE, MessageType: "text/plain", Message: "hello"}}))
+	f.Add(EncodeBEX([]BEX{{Header: FILE_ATTACHMENT, File: &File{PrefixSize: 4000, FileKey: new([32]byte), FileNonce: new([24]byte), FileMIME: "image/png"}}}))
+	f.Add(EncodeBEX([]BEX{{Header: ICE_CANDIDATE, Target: "bob", ICECandidate: "candidate", SDPMLineIndex: 1, SDPMid: "0"}}))
+	f.Add(EncodeBEX([]BEX{{Header: SET_MODERATION_TABLE, TableKey: "keys", Table: []string{"AAAA", "BBBB"}}}))
+	f.Add(EncodeBEX([]BEX{{Header: TRANSCRIPT_HASH, Anchor: "x", Hashes: []string{"a", "b"}}}))
+	f.Add(EncodeBEX([]BEX{{Header: KEY_ROTATION, PublicKey: make([]byte, 32)}}))
+	f.Add([]byte{0x04, 0x45, 0xFF, 0x08})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := DecodeBEX(data)
+		if err != nil {
+			return
+		}
+
+		// Whatever decodes must come back the same from a round trip through the encoder.
+		again, err := DecodeBEX(EncodeBEX(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(again, b) {
+			t.Fatalf("decoded %+v, re-encoded as %+v", b, again)
+		}
+	})
+}
+
+func TestDecodeTruncatedBEX(t *testing.T) {
+	// A text message whose type claims to be 255 bytes long, with nothing after it.
+	if _, err := DecodeBEX([]byte{0x04, 0x45, 0xFF, 0x01, byte(TEXT_MESSAGE), 0xFF, 0x01}); err == nil {
+		t.Fatal("truncated packet was accepted")
+	}
+
+	// Entries of an over-long moderation table must not be read as packets of their own.
+	table := make([]string, 513)
+	for i := range table {
+		table[i] = string([]byte{byte(MOD_ELECTED), 0})
+	}
+	if _, err := DecodeBEX(EncodeBEX([]BEX{{Header: SET_MODERATION_TABLE, Table: table}})); err == nil {
+		t.Fatal("over-long moderation table was accepted")
+	}
+
+	full := EncodeBEX([]BEX{{Header: KEY_ROTATION, PublicKey: make([]byte, 32)}})
+	if _, err := DecodeBEX(full[:len(full)-1]); err == nil {
+		t.Fatal("truncated key rotation was accepted")
+	}
+}
+
+func TestPaddedBEX(t *testing.T) {
+	r := testRoom(New(), "lobby")
+	r.Mp, _ = multiparty.NewMe("bot", "")
+	r.Mp.Padding = multiparty.BucketPadding()
+	testPeer(t, r, "bob")
+
+	var out []byte
+	r.Mp.Out(func(b []byte) {
+		out = b
+	})
+
+	// Extra padding would be read as part of the packet by the web client, so BEX_MAGIC must keep it off.
+	packet := EncodeBEX([]BEX{{Header: SET_COLOR, Color: "#FF00AA"}})
+	r.SendBEXGroup([]BEX{{Header: SET_COLOR, Color: "#FF00AA"}})
+
+	var a multiparty.Answer
+	if err := json.Unmarshal(out, &a); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := base64.StdEncoding.DecodeString(a.Text["bob"].Message)
+	if len(b) != len(packet)+64 {
+		t.Fatal("BEX packet was padded to", len(b), "bytes")
+	}
+}
@@ -0,0 +1,44 @@
+package dog
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+)
+
+// Clock tells the time and waits. It extends multiparty.Clock, so a Conn's Clock is handed on to the rooms it joins.
+type Clock interface {
+	multiparty.Clock
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// SystemClock is the Clock used when Conn.Clock is not set.
+var SystemClock Clock = systemClock{}
+
+func (c *Conn) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+
+	return SystemClock
+}
+
+func (c *Conn) rand() io.Reader {
+	if c.Rand != nil {
+		return c.Rand
+	}
+
+	return rand.Reader
+}
@@ -2,9 +2,11 @@ package dog
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -20,6 +22,10 @@ const (
 	DMDisabled  uint64 = 1 << 1
 	DebugXMPP   uint64 = 1 << 2
 	Human       uint64 = 1 << 3
+	// Exchange transcript checkpoints with other go-cryptodog clients, emitting TranscriptMismatch when they disagree with ours.
+	TranscriptCheck uint64 = 1 << 4
+	// Join messages sent with Room.GroupLong by other go-cryptodog clients back into a single GroupMessage event.
+	Reassemble uint64 = 1 << 5
 )
 
 type Database interface {
@@ -36,12 +42,37 @@ type Conn struct {
 	Conference string
 	Proxy      string
 	Opts       uint64
+	// Receives every stanza sent or received. Takes precedence over the DebugXMPP flag.
+	Tracer xmpp.Tracer
+	// Stanzas larger than this are handled according to OversizedPolicy. Defaults to xmpp.DefaultMaxStanzaSize.
+	MaxStanzaSize   int
+	OversizedPolicy xmpp.OversizedPolicy
+	// What to do when a user shows up with a multiparty key we have not pinned for them.
+	KeyChangePolicy KeyChangePolicy
+	// Messages between transcript checkpoints, when TranscriptCheck is set. Defaults to DefaultTranscriptInterval.
+	TranscriptInterval int
+	// Which multiparty key JoinRoom uses in new rooms.
+	IdentityPolicy IdentityPolicy
+	// Replace the multiparty keys this often. Zero disables rotation.
+	// Only go-cryptodog peers follow a rotation; see RotateKeys for what the web client sees.
+	KeyRotationInterval time.Duration
+	// Source of keys, IVs and nonces. Defaults to crypto/rand.Reader, and should only be replaced in tests.
+	Rand io.Reader
+	// Drives join delays, reconnect backoff and key rotation. Defaults to SystemClock.
+	Clock Clock
+	// Extra padding for group messages, to hide their length. Nil sends the usual 64 bytes only.
+	Padding multiparty.PaddingPolicy
 
 	// Internal variables
 	time   time.Time
-	c      *xmpp.Conn
+	c      xmppConn
+	cl     *sync.Mutex
+	pl     *sync.Mutex
+	mods   map[string]struct{}
 	rooms  map[string]*Room
 	rl     *sync.Mutex
+	queues map[string][]xmpp.Message
+	ql     *sync.Mutex
 	h      map[EventType][]EventHandler
 	hl     *sync.Mutex
 	killed bool
@@ -55,6 +86,10 @@ func New() *Conn {
 	cn.errc = make(chan error)
 	cn.rl = new(sync.Mutex)
 	cn.hl = new(sync.Mutex)
+	cn.cl = new(sync.Mutex)
+	cn.pl = new(sync.Mutex)
+	cn.queues = make(map[string][]xmpp.Message)
+	cn.ql = new(sync.Mutex)
 
 	cn.On(UserJoined, cn.introduction)
 	cn.On(RoomJoined, cn.introduction)
@@ -89,21 +124,77 @@ func (c *Conn) Run() error {
 		c.Conference = "conference.crypto.dog"
 	}
 
+	// Prepared once, so that it compares equal to the domain of parsed JIDs.
+	conference, err := xmpp.PrepareDomain(c.Conference)
+	if err != nil {
+		return err
+	}
+	c.Conference = conference
+
 	if c.DB == nil {
 		c.DB = new(sync.Map)
 	}
 
-	c.time = time.Now()
+	c.time = c.clock().Now()
 
 	c.initKeys()
 
+	if c.KeyRotationInterval > 0 {
+		go c.rotateKeysEvery(c.KeyRotationInterval)
+	}
+
 	go c.populateConnection()
 
 	return <-c.errc
 }
 
 func (c *Conn) Uptime() time.Duration {
-	return time.Since(c.time)
+	return c.clock().Now().Sub(c.time)
+}
+
+// xmppConn is the part of *xmpp.Conn that Conn uses, so that tests can stand in for the server.
+type xmppConn interface {
+	Recv() (interface{}, error)
+	JoinMUC(mjid xmpp.JID) error
+	SendMessage(jid, typeof, body string) error
+	SendComposing(jid, typeof string) error
+	SendPaused(jid, typeof string) error
+	SendChatState(jid, typeof string, state xmpp.ChatState) error
+	Disconnect()
+}
+
+// conn returns the current XMPP connection, which is replaced whenever the bot reconnects.
+// Callers should fetch it for each use rather than holding on to it.
+func (c *Conn) conn() xmppConn {
+	c.cl.Lock()
+	defer c.cl.Unlock()
+	if c.c == nil {
+		// A nil *xmpp.Conn reports errors rather than panicking.
+		return (*xmpp.Conn)(nil)
+	}
+	return c.c
+}
+
+// setConn installs a freshly dialed connection. It returns false, closing xc, if Disconnect was called in the meantime.
+func (c *Conn) setConn(xc xmppConn) bool {
+	c.cl.Lock()
+	killed := c.killed
+	if !killed {
+		c.c = xc
+	}
+	c.cl.Unlock()
+
+	if killed {
+		xc.Disconnect()
+	}
+
+	return !killed
+}
+
+func (c *Conn) isKilled() bool {
+	c.cl.Lock()
+	defer c.cl.Unlock()
+	return c.killed
 }
 
 func (c *Conn) populateConnection() {
@@ -113,17 +204,26 @@ func (c *Conn) populateConnection() {
 
 	for {
 		var err error
+		var xc *xmpp.Conn
+
+		xc, err = xmpp.Dial(xmpp.Opts{
+			URL:    c.URL,
+			Host:   c.Host,
+			Proxy:  c.Proxy,
+			Debug:  c.opt(DebugXMPP),
+			Tracer: c.Tracer,
 
-		c.c, err = xmpp.Dial(xmpp.Opts{
-			URL:   c.URL,
-			Host:  c.Host,
-			Proxy: c.Proxy,
-			Debug: c.opt(DebugXMPP),
+			MaxStanzaSize:   c.MaxStanzaSize,
+			OversizedPolicy: c.OversizedPolicy,
 		})
 		if err != nil {
 			goto hndlErr
 		}
 
+		if !c.setConn(xc) {
+			return
+		}
+
 		period = errPeriod
 
 		c.connectAllRooms()
@@ -136,18 +236,17 @@ func (c *Conn) populateConnection() {
 			err = c.processEvent()
 			if err != nil {
 				goto hndlErr
-				return
 			}
 		}
 
 	hndlErr:
-		c.c.Disconnect()
+		c.conn().Disconnect()
 
 		c.emit(Event{
 			Type: Disconnected,
 		})
 
-		if c.killed == true {
+		if c.isKilled() {
 			return
 		}
 
@@ -156,13 +255,13 @@ func (c *Conn) populateConnection() {
 			float64(period) * 1.6,
 		)
 		yo.L(4).Warn("waiting", period, "to reconnect")
-		time.Sleep(period)
+		c.clock().Sleep(period)
 		continue
 	}
 }
 
 func (c *Conn) processEvent() error {
-	i, err := c.c.Recv()
+	i, err := c.conn().Recv()
 	if err != nil {
 		switch err {
 		case xmpp.RateLimited:
@@ -170,6 +269,9 @@ func (c *Conn) processEvent() error {
 				Type: RateLimit,
 			})
 			return nil
+		case xmpp.StanzaTooLarge:
+			c.emitOversized(i.(xmpp.OversizedStanza))
+			return err
 		default:
 			return err
 		}
@@ -177,31 +279,38 @@ func (c *Conn) processEvent() error {
 
 	switch m := i.(type) {
 	case xmpp.Message:
-		go c.processMessage(m)
+		if m.Type == "groupchat" && c.opt(TranscriptCheck) {
+			c.recordTranscript(m)
+		}
+		c.dispatch(m)
+	case xmpp.OversizedStanza:
+		c.emitOversized(m)
 	case xmpp.NicknameInUse:
 		c.emit(Event{
 			Type: NicknameInUse,
-			Room: m.Local,
-			User: m.Node,
+			Room: xmpp.UnescapeLocal(m.Local),
+			User: m.Resource,
 		})
 	case xmpp.Presence:
 		jid, err := xmpp.ParseJID(m.From)
 		if err != nil {
-			return err
+			yo.L(4).Warn(err)
+			return nil
 		}
 
-		nick := jid.Node
+		nick := jid.Resource
+		room := xmpp.UnescapeLocal(jid.Local)
 
-		rm := c.GetRoom(jid.Local)
+		rm := c.GetRoom(room)
 		if rm != nil {
-			if jid.Host == c.Conference {
-				if jid.Node == rm.MyName {
+			if jid.Domain == c.Conference {
+				if nick == rm.MyName {
 					rm.ml.Lock()
 					if rm.joinedEvent == false {
 						rm.joinedEvent = true
 						rm.ml.Unlock()
 						go func() {
-							time.Sleep(2000 * time.Millisecond)
+							c.clock().Sleep(2000 * time.Millisecond)
 							rm.emit(Event{
 								Type: RoomJoined,
 							})
@@ -216,14 +325,18 @@ func (c *Conn) processEvent() error {
 		switch m.Type {
 		case "unavailable":
 			go func() {
-				rm := c.GetRoom(jid.Local)
+				rm := c.GetRoom(room)
+				if rm == nil {
+					return
+				}
 				rm.ml.Lock()
 				delete(rm.Members, nick)
 				rm.ml.Unlock()
+				rm.flushLong(nick)
 				rm.Mp.DestroyUser(nick)
 				c.emit(Event{
 					Type: UserLeft,
-					Room: jid.Local,
+					Room: room,
 					User: nick,
 				})
 			}()
@@ -233,8 +346,25 @@ func (c *Conn) processEvent() error {
 	return nil
 }
 
+func (c *Conn) emitOversized(o xmpp.OversizedStanza) {
+	evt := Event{
+		Type: OversizedStanza,
+		Size: o.Size,
+	}
+
+	if jid, err := xmpp.ParseJID(o.From); err == nil {
+		evt.Room = xmpp.UnescapeLocal(jid.Local)
+		evt.User = jid.Resource
+	}
+
+	c.emit(evt)
+}
+
 func (c *Conn) SetMods(s []string) {
+	c.pl.Lock()
+	c.mods = fingerprintSet(s)
 	c.storeJSON("mods", s)
+	c.pl.Unlock()
 }
 
 func (c *Conn) GetMods() []string {
@@ -243,42 +373,81 @@ func (c *Conn) GetMods() []string {
 	return s
 }
 
+// isModFingerprint reports whether fp belongs to a moderator, loading the list on first use.
+func (c *Conn) isModFingerprint(fp string) bool {
+	c.pl.Lock()
+	defer c.pl.Unlock()
+
+	if c.mods == nil {
+		c.mods = fingerprintSet(c.GetMods())
+	}
+
+	_, ok := c.mods[fp]
+	return ok
+}
+
+func fingerprintSet(fps []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(fps))
+	for _, v := range fps {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// dispatch queues a message for processing. Messages from different senders are processed concurrently,
+// but each sender's are processed one at a time in the order they arrived, so that a KEY_ROTATION
+// or CONTINUATION takes effect before the messages that follow it.
+func (c *Conn) dispatch(msg xmpp.Message) {
+	c.ql.Lock()
+	q, running := c.queues[msg.From]
+	c.queues[msg.From] = append(q, msg)
+	c.ql.Unlock()
+
+	if !running {
+		go c.drain(msg.From)
+	}
+}
+
+// drain processes the messages queued for a sender until there are none left.
+func (c *Conn) drain(from string) {
+	for {
+		c.ql.Lock()
+		q := c.queues[from]
+		if len(q) == 0 {
+			delete(c.queues, from)
+			c.ql.Unlock()
+			return
+		}
+		msg := q[0]
+		c.queues[from] = q[1:]
+		c.ql.Unlock()
+
+		c.processMessage(msg)
+	}
+}
+
 func (c *Conn) processMessage(msg xmpp.Message) {
 	jid, err := xmpp.ParseJID(msg.From)
 	if err != nil {
 		yo.Warn(err)
 		return
 	}
-	nick := jid.Node
-	to, err := xmpp.ParseJID(msg.To)
-	if err != nil {
-		yo.Warn(err)
-		return
-	}
+	nick := jid.Resource
+	room := xmpp.UnescapeLocal(jid.Local)
 	switch msg.Type {
 	case "groupchat":
-		rm := c.GetRoom(jid.Local)
+		rm := c.GetRoom(room)
 		if rm == nil {
-			yo.Fatal(to.Local, "does not exist", msg.To)
-		}
-
-		if nick == rm.MyName {
+			yo.Warn(room, "does not exist", msg.From)
 			return
 		}
 
-		if msg.Id == "composing" {
-			rm.emit(Event{
-				Type: Composing,
-				User: nick,
-			})
+		if nick == rm.MyName {
 			return
 		}
 
-		if msg.Id == "paused" {
-			rm.emit(Event{
-				Type: Paused,
-				User: nick,
-			})
+		c.processChatState(room, nick, msg, false)
+		if msg.Body == "" {
 			return
 		}
 
@@ -286,16 +455,40 @@ func (c *Conn) processMessage(msg xmpp.Message) {
 			return
 		}
 
-		newUser, data, err := rm.Mp.ReceiveMessage(nick, msg.Body)
-		if err != nil {
+		rcv, err := rm.Mp.ReceiveMessage(nick, msg.Body)
+		rm.emitKeyEvents()
+		switch {
+		case errors.Is(err, multiparty.ErrKeyChange):
+			rm.changeKey(nick, rcv.PublicKey)
+			return
+		case errors.Is(err, multiparty.ErrReplay):
+			yo.L(4).Warn(nick, err)
+			return
+		case errors.Is(err, multiparty.ErrNotForMe) && rm.Mp.HasSharedKey(nick):
+			// We share a key, so the sender left us out on purpose, as GroupTo does.
+			rm.emit(Event{
+				Type:       ExcludedGroupMessage,
+				User:       nick,
+				Recipients: rcv.Recipients,
+			})
+			return
+		case err != nil:
 			yo.L(4).Warn(err)
+			if errors.Is(err, multiparty.ErrNotForMe) || errors.Is(err, multiparty.ErrUnknownSender) {
+				rm.Mp.Resync(nick)
+			}
 			rm.emit(Event{
 				Type: InvalidGroupMessage,
 				User: nick,
-				Room: jid.Local,
+				Room: room,
+				Body: err.Error(),
 			})
-		} else {
-			if newUser != "" {
+			return
+		}
+
+		switch rcv.Kind {
+		case multiparty.KeyAnnouncement:
+			if rcv.NewUser != "" {
 				rm.ml.Lock()
 				rm.Members[nick] = &Member{
 					false,
@@ -305,20 +498,28 @@ func (c *Conn) processMessage(msg xmpp.Message) {
 					nil,
 				}
 				rm.ml.Unlock()
-				if time.Since(c.time) > 4000*time.Millisecond {
+				if c.Uptime() > 4000*time.Millisecond {
 					go func() {
-						time.Sleep(800 * time.Millisecond)
+						c.clock().Sleep(800 * time.Millisecond)
 						c.emit(Event{
 							Type: UserJoined,
 							User: nick,
-							Room: jid.Local,
+							Room: room,
 						})
 					}()
 				}
 			}
+		case multiparty.Payload:
+			if len(rcv.Omitted) > 0 {
+				rm.emit(Event{
+					Type:    PartialRecipients,
+					User:    nick,
+					Omitted: rcv.Omitted,
+				})
+			}
 
-			if len(data) > 0 {
-				c.processGroupchatBytes(jid.Local, nick, data)
+			if len(rcv.Plaintext) > 0 {
+				c.processGroupchatBytes(room, nick, rcv.Plaintext, rcv.Recipients)
 			}
 		}
 	case "chat":
@@ -327,10 +528,15 @@ func (c *Conn) processMessage(msg xmpp.Message) {
 			return
 		}
 
+		c.processChatState(room, nick, msg, true)
+		if msg.Body == "" {
+			return
+		}
+
 		yo.L(4).Warn("DM not disabled")
 
-		room := c.GetRoom(jid.Local)
-		memb := room.GetMember(nick)
+		rm := c.GetRoom(room)
+		memb := rm.GetMember(nick)
 		if memb == nil {
 			yo.Warn("No member", nick)
 			return
@@ -344,34 +550,70 @@ func (c *Conn) processMessage(msg xmpp.Message) {
 			yo.Warn(msg.Body)
 			yo.L(4).Warn(err)
 		} else {
-			targetJID := xmpp.JID{
-				Local: jid.Local,
-				Host:  c.Conference,
-				Node:  nick,
-			}
+			targetJID := jid.String()
 			yo.L(4).Warn("Sending off", len(toSend), targetJID)
 			for _, v := range toSend {
-				c.c.SendMessage(targetJID.String(), "chat", string(v))
+				c.conn().SendMessage(targetJID, "chat", string(v))
 			}
 			if str := string(plain); str != "" {
-				c.processPrivateString(jid.Local, nick, str)
+				c.processPrivateString(room, nick, str)
 			}
 		}
 	}
 }
 
-func (c *Conn) processGroupchatBytes(room, user string, body []byte) {
+// processChatState maps XEP-0085 notifications onto Composing and Paused events.
+func (c *Conn) processChatState(room, user string, msg xmpp.Message, private bool) {
+	var evt EventType
+
+	switch msg.State() {
+	case xmpp.ChatComposing:
+		evt = Composing
+	case xmpp.ChatPaused, xmpp.ChatInactive, xmpp.ChatGone:
+		evt = Paused
+	case xmpp.ChatActive:
+		// Every message carries <active/>, so it only means the user stopped typing when sent on its own.
+		if msg.Body != "" {
+			return
+		}
+		evt = Paused
+	default:
+		return
+	}
+
+	c.emit(Event{
+		Type:    evt,
+		Private: private,
+		Room:    room,
+		User:    user,
+	})
+}
+
+func (c *Conn) processGroupchatBytes(room, user string, body []byte, recipients []string) {
+	rm := c.GetRoom(room)
+	if rm == nil {
+		return
+	}
+
 	if len(body) > 3 && bytes.Equal(body[:3], BEX_MAGIC) {
 		if !c.opt(BEXDisabled) {
-			c.GetRoom(room).handleGroupBEXPacket(user, body)
+			rm.handleGroupBEXPacket(user, body)
 		}
 	} else {
-		c.emit(Event{
-			Type: GroupMessage,
-			Room: room,
-			User: user,
-			Body: string(body),
-		})
+		texts := []string{string(body)}
+		if c.opt(Reassemble) {
+			texts = rm.takeChunk(user, texts[0])
+		}
+
+		for _, text := range texts {
+			c.emit(Event{
+				Type:       GroupMessage,
+				Room:       room,
+				User:       user,
+				Body:       text,
+				Recipients: recipients,
+			})
+		}
 	}
 }
 
@@ -387,8 +629,8 @@ func (c *Conn) processPrivateString(room, user string, body string) {
 		})
 	} else {
 		if len(b64) > 3 && bytes.Equal(b64[:3], BEX_MAGIC) {
-			if !c.opt(BEXDisabled) {
-				c.GetRoom(room).handlePrivateBEXPacket(user, b64)
+			if rm := c.GetRoom(room); rm != nil && !c.opt(BEXDisabled) {
+				rm.handlePrivateBEXPacket(user, b64)
 			}
 		} else {
 			c.emit(Event{
@@ -402,12 +644,6 @@ func (c *Conn) processPrivateString(room, user string, body string) {
 	}
 }
 
-func (c *Conn) loadRooms() map[string]string {
-	var rooms map[string]string
-	c.loadJSON("rooms", &rooms)
-	return rooms
-}
-
 func (c *Conn) loadJSON(str string, v interface{}) {
 	data, ok := c.DB.Load(str)
 	if ok {
@@ -443,70 +679,97 @@ func (c *Conn) connectAllRooms() {
 	c.rooms = make(map[string]*Room)
 
 	for k, v := range c.loadRooms() {
-		c.joinMuc(k, v)
+		mjid, err := xmpp.MUCJID(k, c.Conference, v.Nick)
+		if err == nil {
+			err = c.joinMuc(mjid, v.Identity)
+		}
+		if err != nil {
+			yo.L(4).Warn(err)
+		}
 	}
 
 	c.rl.Unlock()
 }
 
 func (c *Conn) initKeys() {
+	c.pl.Lock()
 	if c.loadString("mp") == "" {
-		buf := make([]byte, 32)
-		rand.Read(buf)
-		c.storeString("mp", base64.StdEncoding.EncodeToString(buf))
+		c.storeString("mp", c.newSecret())
 	}
+	c.pl.Unlock()
 
 	if c.loadString("otr") == "" && !c.opt(DMDisabled) {
 		ok := new(otr3.DSAPrivateKey)
-		ok.Generate(rand.Reader)
+		ok.Generate(c.rand())
 
 		serial := base64.StdEncoding.EncodeToString(ok.Serialize())
 
 		c.storeString("otr", serial)
-
-		yo.L(4).Ok("OTR KEY", serial)
 	}
 }
 
-func (c *Conn) JoinRoom(room, nick string) {
+// JoinRoom joins a room under the given nickname, using the connection's IdentityPolicy.
+// An invalid room name or nickname is reported before anything is sent to the server.
+func (c *Conn) JoinRoom(room, nick string) error {
+	return c.JoinRoomIdentity(room, nick, c.IdentityPolicy)
+}
+
+// JoinRoomIdentity is like JoinRoom, but chooses the multiparty key according to policy.
+// The policy is remembered and used again whenever the room is rejoined.
+func (c *Conn) JoinRoomIdentity(room, nick string, policy IdentityPolicy) error {
 	if c == nil {
-		yo.L(4).Warn("Cannot join with nil connection")
-		return
+		return fmt.Errorf("dog: cannot join with nil connection")
+	}
+
+	mjid, err := xmpp.MUCJID(room, c.Conference, nick)
+	if err != nil {
+		return err
 	}
 
 	c.rl.Lock()
 	defer c.rl.Unlock()
-	if r := c.rooms[room]; r != nil {
-		return
+	if r := c.rooms[xmpp.UnescapeLocal(mjid.Local)]; r != nil {
+		return nil
 	}
 
-	c.joinMuc(room, nick)
+	return c.joinMuc(mjid, policy)
 }
 
-func (c *Conn) joinMuc(room, nick string) {
+// joinMuc joins the room at mjid, an occupant address from xmpp.MUCJID. c.rl must be held.
+func (c *Conn) joinMuc(mjid xmpp.JID, policy IdentityPolicy) error {
+	room := xmpp.UnescapeLocal(mjid.Local)
+	nick := mjid.Resource
+
 	r := new(Room)
 	r.ModerationTables = make(map[string][]string)
 	r.Name = room
 	r.MyName = nick
-	r.Mp, _ = multiparty.NewMe(nick, c.loadString("mp"))
+	r.Identity = policy
+	r.Mp, _ = multiparty.NewMe(nick, c.identity(room, policy))
+	r.Mp.Rand = c.rand()
+	r.Mp.Clock = c.clock()
+	r.Mp.Replay.Clock = c.clock()
+	r.Mp.Padding = c.Padding
 	r.Mp.Out(r.transmitMp)
+	r.Mp.FilterKeys(r.checkPin)
 	r.c = c
 	r.Members = make(map[string]*Member)
 	r.ml = new(sync.Mutex)
+	r.tr = new(transcript)
 	c.rooms[room] = r
-	ms := make(map[string]string)
-	for k, v := range c.rooms {
-		ms[k] = v.MyName
-	}
-	c.storeJSON("rooms", ms)
+	c.saveRooms()
 
-	c.c.JoinMUC(r.Name, c.Conference, r.MyName)
+	if err := c.conn().JoinMUC(mjid); err != nil {
+		return err
+	}
 
 	go func(_room *Room) {
-		time.Sleep(200 * time.Millisecond)
+		c.clock().Sleep(200 * time.Millisecond)
 		_room.Mp.RequestPublicKey("")
 		_room.Mp.SendPublicKey("")
 	}(r)
+
+	return nil
 }
 
 func (c *Conn) DM(room, user, message string) {
@@ -526,10 +789,13 @@ func (c *Conn) Disconnect() {
 		return
 	}
 
+	c.cl.Lock()
 	c.killed = true
+	c.cl.Unlock()
+
 	go func() {
 		c.errc <- nil
 	}()
 
-	c.c.Disconnect()
+	c.conn().Disconnect()
 }
@@ -0,0 +1,170 @@
+package dog
+
+import (
+	"encoding/xml"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cryptodog/go-cryptodog/xmpp"
+)
+
+// fakeXMPP stands in for an XMPP connection. It counts the stanzas sent through it and fails sends once disconnected.
+type fakeXMPP struct {
+	sent   int32
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeXMPP() *fakeXMPP {
+	return &fakeXMPP{closed: make(chan struct{})}
+}
+
+func (f *fakeXMPP) send() error {
+	select {
+	case <-f.closed:
+		return xmpp.Closed
+	default:
+	}
+
+	atomic.AddInt32(&f.sent, 1)
+	return nil
+}
+
+func (f *fakeXMPP) Recv() (interface{}, error) {
+	<-f.closed
+	return nil, xmpp.Closed
+}
+
+func (f *fakeXMPP) JoinMUC(xmpp.JID) error {
+	return f.send()
+}
+
+func (f *fakeXMPP) SendMessage(jid, typeof, body string) error {
+	return f.send()
+}
+
+func (f *fakeXMPP) SendComposing(jid, typeof string) error {
+	return f.send()
+}
+
+func (f *fakeXMPP) SendPaused(jid, typeof string) error {
+	return f.send()
+}
+
+func (f *fakeXMPP) SendChatState(jid, typeof string, state xmpp.ChatState) error {
+	return f.send()
+}
+
+func (f *fakeXMPP) Disconnect() {
+	f.once.Do(func() {
+		close(f.closed)
+	})
+}
+
+func TestReconnectSwap(t *testing.T) {
+	c := New()
+	first, second := newFakeXMPP(), newFakeXMPP()
+	if !c.setConn(first) {
+		t.Fatal("first connection was refused")
+	}
+
+	const senders, each = 8, 200
+	var sent, closed int32
+	var started, wg sync.WaitGroup
+	started.Add(senders)
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for i := 0; i < each; i++ {
+				switch err := c.conn().SendMessage("lobby@conference.crypto.dog", "groupchat", "hi"); err {
+				case nil:
+					atomic.AddInt32(&sent, 1)
+				case xmpp.Closed:
+					atomic.AddInt32(&closed, 1)
+				default:
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Reconnect as Run does while the senders are busy: drop the old connection, then install the new one.
+	started.Wait()
+	c.conn().Disconnect()
+	if !c.setConn(second) {
+		t.Fatal("second connection was refused")
+	}
+	wg.Wait()
+
+	if sent+closed != senders*each {
+		t.Fatal("sends went missing:", sent, "sent and", closed, "closed")
+	}
+
+	before := atomic.LoadInt32(&second.sent)
+	if err := c.conn().SendMessage("lobby@conference.crypto.dog", "groupchat", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&second.sent) != before+1 {
+		t.Fatal("send after reconnecting did not use the new connection")
+	}
+
+	// Every successful send reached one of the connections.
+	if got := atomic.LoadInt32(&first.sent) + atomic.LoadInt32(&second.sent); got != sent+1 {
+		t.Fatal("connections got", got, "messages, but", sent+1, "sends succeeded")
+	}
+
+	// A connection dialed after Disconnect is closed rather than installed.
+	c.Disconnect()
+	late := newFakeXMPP()
+	if c.setConn(late) {
+		t.Fatal("connection installed after Disconnect")
+	}
+	select {
+	case <-late.closed:
+	default:
+		t.Fatal("late connection was left open")
+	}
+}
+
+func TestPrivateChatStates(t *testing.T) {
+	c := New()
+	c.Opts = DMDisabled
+	testRoom(c, "lobby")
+
+	states := make(chan Event, 2)
+	c.On(Composing, func(e Event) {
+		states <- e
+	})
+	c.On(Paused, func(e Event) {
+		states <- e
+	})
+
+	state := func(cs xmpp.ChatState) xmpp.Message {
+		return xmpp.Message{
+			Type:  "chat",
+			From:  "lobby@conference.crypto.dog/bob",
+			Extra: []xmpp.Element{{XMLName: xml.Name{Space: xmpp.NSChatStates, Local: string(cs)}}},
+		}
+	}
+
+	// With DMs disabled, private chat states are ignored like the messages they go with.
+	c.processMessage(state(xmpp.ChatComposing))
+
+	c.Opts = 0
+	c.processMessage(state(xmpp.ChatPaused))
+
+	if e := <-states; e.Type != Paused || !e.Private || e.User != "bob" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	select {
+	case e := <-states:
+		t.Fatalf("chat state emitted with DMs disabled: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
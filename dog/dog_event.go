@@ -29,6 +29,15 @@ const (
 	WebRTCAnswer
 	WebRTCIceCandidate
 	InvalidGroupMessage
+	OversizedStanza
+	KeyChanged
+	PartialRecipients
+	// Another member's transcript checkpoint disagrees with ours. Body holds the tag of the last message both transcripts agree on.
+	TranscriptMismatch
+	// A member replaced their pinned multiparty key with one vouched for by the old key.
+	KeyRotated
+	// A member we share a key with sent a group message that left us out. Recipients holds who it was for.
+	ExcludedGroupMessage
 )
 
 // Event describes
@@ -39,6 +48,17 @@ type Event struct {
 	User    string
 	Body    string
 	File    *File
+	Size    int
+
+	// Set on KeyChanged and KeyRotated events.
+	Fingerprint          string
+	PreviousFingerprints []string
+
+	// Set on PartialRecipients events: members with keys that the sender did not encrypt for.
+	Omitted []string
+	// Set on GroupMessage events: everyone the sender encrypted the message for, including us.
+	// On ExcludedGroupMessage events, everyone it was for.
+	Recipients []string
 }
 
 // On registers a function that will handle an Event.
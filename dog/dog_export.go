@@ -0,0 +1,180 @@
+package dog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	BadPassphrase = errors.New("dog: wrong passphrase or corrupted identity export")
+)
+
+// scrypt cost for new exports. Imports use the parameters stored in the export.
+var exportScryptN = 1 << 17
+
+const (
+	exportVersion = 1
+	exportScryptR = 8
+	exportScryptP = 1
+
+	// Refuse imports that would make us allocate more than 1 GiB.
+	maxScryptMemory = 1 << 30
+)
+
+// identityExport is the encrypted form produced by ExportIdentity.
+type identityExport struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Box     []byte `json:"box"`
+}
+
+// identity holds every secret that makes up the bot's identity.
+// The Database interface stores strings, which cannot be wiped, so the secrets stay base64 strings here too.
+// These secret strings remain in memory for as long as the process runs:
+//   - "mp", the global multiparty key, which is also passed to multiparty.NewMe and returned by SaveProfile
+//   - "otr", the serialized OTR DSA private key, which is decoded again for each Member's conversation
+//   - "roomkeys", the RoomIdentity keys, and the key made up for each EphemeralIdentity room
+//   - the passphrase given to ExportIdentity or ImportIdentity
+type identity struct {
+	MP       string            `json:"mp"`
+	OTR      string            `json:"otr,omitempty"`
+	RoomKeys map[string]string `json:"roomkeys,omitempty"`
+}
+
+// wipeBytes overwrites secrets we are done with. Copies made by the runtime or kept in strings are out of reach.
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func exportKey(passphrase string, salt []byte, n, r, p int) (*[32]byte, error) {
+	dk, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], dk)
+	wipeBytes(dk)
+	return &key, nil
+}
+
+// ExportIdentity returns the multiparty, per-room and OTR keys, encrypted with a key derived from passphrase using scrypt.
+func (c *Conn) ExportIdentity(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("dog: empty passphrase")
+	}
+
+	id := identity{
+		MP:  c.loadString("mp"),
+		OTR: c.loadString("otr"),
+	}
+	c.loadJSON("roomkeys", &id.RoomKeys)
+
+	if id.MP == "" {
+		return nil, fmt.Errorf("dog: no identity to export")
+	}
+
+	plain, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ex := identityExport{
+		Version: exportVersion,
+		KDF:     "scrypt",
+		N:       exportScryptN,
+		R:       exportScryptR,
+		P:       exportScryptP,
+		Salt:    make([]byte, 32),
+		Nonce:   make([]byte, 24),
+	}
+
+	if _, err := io.ReadFull(c.rand(), ex.Salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(c.rand(), ex.Nonce); err != nil {
+		return nil, err
+	}
+
+	key, err := exportKey(passphrase, ex.Salt, ex.N, ex.R, ex.P)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], ex.Nonce)
+	ex.Box = secretbox.Seal(nil, plain, &nonce, key)
+	wipeBytes(plain)
+	wipeBytes(key[:])
+
+	return json.MarshalIndent(ex, "", "  ")
+}
+
+// ImportIdentity decrypts an export made by ExportIdentity and replaces the stored keys with it.
+// Rooms already joined keep their current keys until they are rejoined.
+func (c *Conn) ImportIdentity(data []byte, passphrase string) error {
+	var ex identityExport
+	if err := json.Unmarshal(data, &ex); err != nil {
+		return fmt.Errorf("dog: invalid identity export: %s", err)
+	}
+
+	if ex.Version != exportVersion || ex.KDF != "scrypt" {
+		return fmt.Errorf("dog: unsupported identity export version %d (%s)", ex.Version, ex.KDF)
+	}
+
+	if ex.R <= 0 || ex.P <= 0 || ex.N <= 1 || 128*int64(ex.N)*int64(ex.R) > maxScryptMemory || ex.P > 16 {
+		return fmt.Errorf("dog: identity export has unreasonable scrypt parameters")
+	}
+
+	if len(ex.Nonce) != 24 {
+		return BadPassphrase
+	}
+
+	key, err := exportKey(passphrase, ex.Salt, ex.N, ex.R, ex.P)
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], ex.Nonce)
+	plain, ok := secretbox.Open(nil, ex.Box, &nonce, key)
+	wipeBytes(key[:])
+	if !ok {
+		return BadPassphrase
+	}
+
+	var id identity
+	err = json.Unmarshal(plain, &id)
+	wipeBytes(plain)
+	if err != nil || id.MP == "" {
+		return BadPassphrase
+	}
+
+	c.pl.Lock()
+	c.storeString("mp", id.MP)
+	if id.OTR != "" {
+		c.storeString("otr", id.OTR)
+	}
+
+	if id.RoomKeys != nil {
+		c.storeJSON("roomkeys", id.RoomKeys)
+	} else {
+		c.DB.Delete("roomkeys")
+	}
+	c.pl.Unlock()
+
+	return nil
+}
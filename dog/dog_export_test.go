@@ -0,0 +1,38 @@
+package dog
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestExportIdentity(t *testing.T) {
+	defer func(n int) { exportScryptN = n }(exportScryptN)
+	exportScryptN = 1 << 10
+
+	c := New()
+	c.DB = new(sync.Map)
+	c.Opts = DMDisabled
+	c.initKeys()
+	room := c.identity("lobby", RoomIdentity)
+
+	data, err := c.ExportIdentity("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := New()
+	d.DB = new(sync.Map)
+
+	if err := d.ImportIdentity(data, "wrong horse"); !errors.Is(err, BadPassphrase) {
+		t.Fatal("expected BadPassphrase, got", err)
+	}
+
+	if err := d.ImportIdentity(data, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.loadString("mp") != c.loadString("mp") || d.identity("lobby", RoomIdentity) != room {
+		t.Fatal("imported identity differs from the exported one")
+	}
+}
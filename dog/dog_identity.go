@@ -0,0 +1,79 @@
+package dog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+)
+
+// IdentityPolicy decides which multiparty key the bot uses in a room.
+type IdentityPolicy int
+
+const (
+	// Use the key in the "mp" record everywhere. Anyone in two of the bot's rooms can tell it is the same bot.
+	GlobalIdentity IdentityPolicy = iota
+	// Use a key generated for the room and kept in the "roomkeys" record, so the bot is recognizable across sessions of the same room only.
+	RoomIdentity
+	// Generate a new key every time the room is joined.
+	EphemeralIdentity
+)
+
+// roomRecord is how a joined room is stored in the "rooms" record.
+type roomRecord struct {
+	Nick     string         `json:"nick"`
+	Identity IdentityPolicy `json:"identity"`
+}
+
+// Older versions stored only the nickname.
+func (rr *roomRecord) UnmarshalJSON(b []byte) error {
+	var nick string
+	if err := json.Unmarshal(b, &nick); err == nil {
+		*rr = roomRecord{Nick: nick}
+		return nil
+	}
+
+	type plain roomRecord
+	return json.Unmarshal(b, (*plain)(rr))
+}
+
+func (c *Conn) loadRooms() map[string]roomRecord {
+	rooms := make(map[string]roomRecord)
+	c.loadJSON("rooms", &rooms)
+	return rooms
+}
+
+// saveRooms must be called with rl held.
+func (c *Conn) saveRooms() {
+	rooms := make(map[string]roomRecord)
+	for k, v := range c.rooms {
+		rooms[k] = roomRecord{v.MyName, v.Identity}
+	}
+	c.storeJSON("rooms", rooms)
+}
+
+func (c *Conn) newSecret() string {
+	buf := make([]byte, 32)
+	io.ReadFull(c.rand(), buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// identity returns the multiparty profile to use in a room under the given policy.
+func (c *Conn) identity(room string, policy IdentityPolicy) string {
+	switch policy {
+	case RoomIdentity:
+		c.pl.Lock()
+		defer c.pl.Unlock()
+
+		keys := make(map[string]string)
+		c.loadJSON("roomkeys", &keys)
+		if keys[room] == "" {
+			keys[room] = c.newSecret()
+			c.storeJSON("roomkeys", keys)
+		}
+		return keys[room]
+	case EphemeralIdentity:
+		return c.newSecret()
+	}
+
+	return c.loadString("mp")
+}
@@ -0,0 +1,47 @@
+package dog
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	c := New()
+	c.DB = new(sync.Map)
+	c.initKeys()
+
+	if c.identity("a", GlobalIdentity) != c.identity("b", GlobalIdentity) {
+		t.Fatal("global identity should be shared between rooms")
+	}
+
+	a := c.identity("a", RoomIdentity)
+	if a == c.identity("b", RoomIdentity) || a == c.identity("a", GlobalIdentity) {
+		t.Fatal("room identity should be unique to the room")
+	}
+	if a != c.identity("a", RoomIdentity) {
+		t.Fatal("room identity should persist")
+	}
+
+	if c.identity("a", EphemeralIdentity) == c.identity("a", EphemeralIdentity) {
+		t.Fatal("ephemeral identity should change on every join")
+	}
+}
+
+func TestLegacyRoomsRecord(t *testing.T) {
+	c := New()
+	c.DB = new(sync.Map)
+	c.DB.Store("rooms", `{"lobby": "bot"}`)
+
+	rr := c.loadRooms()["lobby"]
+	if rr.Nick != "bot" || rr.Identity != GlobalIdentity {
+		t.Fatalf("unexpected record %+v", rr)
+	}
+
+	testRoom(c, "lobby").MyName = "bot"
+	c.rooms["lobby"].Identity = RoomIdentity
+	c.saveRooms()
+
+	if rr := c.loadRooms()["lobby"]; rr.Nick != "bot" || rr.Identity != RoomIdentity {
+		t.Fatalf("unexpected record %+v", rr)
+	}
+}
@@ -0,0 +1,223 @@
+package dog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// The most chunks a long message may be split into, and the most a receiver will buffer from one sender.
+	maxChunks = 256
+	// The most senders whose long messages a room buffers at once; the oldest is given up to make room.
+	maxLongSenders = 8
+	// How long a long message may take to arrive before what came of it is passed on as it is.
+	maxLongAge = 2 * time.Minute
+)
+
+var TooLong = errors.New("dog: message needs too many chunks")
+
+type longMessage struct {
+	chunks  uint64
+	parts   []string
+	started time.Time
+}
+
+func chunkPrefix(i, n int) string {
+	return fmt.Sprintf("[%d/%d] ", i+1, n)
+}
+
+// GroupLong sends text to the room, splitting it on line boundaries into numbered chunks when it is too large for one message.
+// Every client can read the chunks; go-cryptodog peers with Reassemble set receive the whole text as one GroupMessage.
+func (r *Room) GroupLong(text string) error {
+	if !utf8.ValidString(text) {
+		return fmt.Errorf("dog: invalid utf-8 string")
+	}
+
+	size := r.Mp.MaxPlaintextSize()
+	if len(text) <= size {
+		return r.GM(text)
+	}
+
+	chunks := splitLines(text, size-len(chunkPrefix(maxChunks-1, maxChunks)))
+	if len(chunks) > maxChunks {
+		return TooLong
+	}
+
+	r.ll.Lock()
+	defer r.ll.Unlock()
+
+	// A marker announces how many chunks follow. Stanzas from one sender are handled in order, so receivers see it first.
+	if err := r.Group(EncodeBEX([]BEX{{
+		Header: CONTINUATION,
+		Chunks: uint64(len(chunks)),
+	}})); err != nil {
+		return err
+	}
+
+	for i, v := range chunks {
+		if err := r.GM(chunkPrefix(i, len(chunks)) + v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitLines cuts text into pieces of at most size bytes, after a newline where possible.
+// Concatenating the pieces gives back text.
+func splitLines(text string, size int) []string {
+	var chunks []string
+
+	for len(text) > size {
+		cut := strings.LastIndexByte(text[:size], '\n') + 1
+		if cut == 0 {
+			// A line longer than a chunk is cut where it has to be, between runes.
+			cut = size
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = size
+			}
+		}
+
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+
+	return append(chunks, text)
+}
+
+// expectLong records that the next n text messages from user are the chunks of a long message.
+// Anything still being received from user is passed on as it is.
+func (r *Room) expectLong(user string, n uint64) {
+	now := r.c.clock().Now()
+
+	r.ml.Lock()
+	if r.long == nil {
+		r.long = make(map[string]*longMessage)
+	}
+
+	given := r.expireLong(now)
+	given = r.giveUp(given, user)
+
+	if n >= 2 && n <= maxChunks {
+		if len(r.long) >= maxLongSenders {
+			given = r.giveUp(given, r.oldestLong())
+		}
+
+		r.long[user] = &longMessage{chunks: n, started: now}
+	}
+	r.ml.Unlock()
+
+	r.emitGivenUp(given)
+}
+
+// takeChunk passes a text message from user through reassembly, returning the bodies to emit in order:
+// the message itself when it is not an expected chunk, or the whole long message once its last chunk arrives.
+func (r *Room) takeChunk(user, text string) []string {
+	r.ml.Lock()
+	given := r.expireLong(r.c.clock().Now())
+	bodies := r.takeChunkLocked(user, text)
+	r.ml.Unlock()
+
+	r.emitGivenUp(given)
+	return bodies
+}
+
+func (r *Room) takeChunkLocked(user, text string) []string {
+	lm := r.long[user]
+	if lm == nil {
+		return []string{text}
+	}
+
+	prefix := chunkPrefix(len(lm.parts), int(lm.chunks))
+	if !strings.HasPrefix(text, prefix) {
+		// Something else was sent among the chunks, so give up on the long message without losing what came of it.
+		if partial := r.abandon(user); partial != "" {
+			return []string{partial, text}
+		}
+		return []string{text}
+	}
+
+	lm.parts = append(lm.parts, text[len(prefix):])
+	if uint64(len(lm.parts)) < lm.chunks {
+		return nil
+	}
+
+	return []string{r.abandon(user)}
+}
+
+// flushLong passes on what has arrived of a long message from user, who is no longer there to finish it.
+// With no user, it does so for every sender.
+func (r *Room) flushLong(user string) {
+	var given []Event
+
+	r.ml.Lock()
+	for u := range r.long {
+		if user == "" || u == user {
+			given = r.giveUp(given, u)
+		}
+	}
+	r.ml.Unlock()
+
+	r.emitGivenUp(given)
+}
+
+// abandon forgets the long message being received from user, returning what had arrived of it. ml must be held.
+func (r *Room) abandon(user string) string {
+	lm := r.long[user]
+	delete(r.long, user)
+	if lm == nil {
+		return ""
+	}
+
+	return strings.Join(lm.parts, "")
+}
+
+// giveUp abandons the long message from user, adding what had arrived of it to given. ml must be held.
+func (r *Room) giveUp(given []Event, user string) []Event {
+	if partial := r.abandon(user); partial != "" {
+		given = append(given, Event{
+			Type: GroupMessage,
+			User: user,
+			Body: partial,
+		})
+	}
+
+	return given
+}
+
+// expireLong gives up on long messages older than maxLongAge. ml must be held.
+func (r *Room) expireLong(now time.Time) []Event {
+	var given []Event
+	for u, lm := range r.long {
+		if now.Sub(lm.started) > maxLongAge {
+			given = r.giveUp(given, u)
+		}
+	}
+
+	return given
+}
+
+// oldestLong returns the sender whose long message started first. ml must be held.
+func (r *Room) oldestLong() string {
+	var oldest string
+	var started time.Time
+	for u, lm := range r.long {
+		if oldest == "" || lm.started.Before(started) {
+			oldest, started = u, lm.started
+		}
+	}
+
+	return oldest
+}
+
+func (r *Room) emitGivenUp(given []Event) {
+	for _, e := range given {
+		r.emit(e)
+	}
+}
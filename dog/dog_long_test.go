@@ -0,0 +1,237 @@
+package dog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/Cryptodog/go-cryptodog/xmpp"
+)
+
+func TestSplitLines(t *testing.T) {
+	text := "short\n" + strings.Repeat("é", 30) + "\nend\n"
+
+	chunks := splitLines(text, 16)
+	if strings.Join(chunks, "") != text {
+		t.Fatal("chunks do not add up to the text", chunks)
+	}
+
+	if chunks[0] != "short\n" {
+		t.Fatalf("first chunk should end at a newline: %q", chunks[0])
+	}
+
+	for _, v := range chunks {
+		if len(v) > 16 || !utf8.ValidString(v) {
+			t.Fatalf("bad chunk %q", v)
+		}
+	}
+}
+
+// longPair returns a room whose messages are decrypted by bob and handed to a receiving Conn with the given options.
+func longPair(t *testing.T, opts uint64) (*Room, chan Event) {
+	r := testRoom(New(), "lobby")
+	r.Mp, _ = multiparty.NewMe("bot", "")
+	r.Mp.MaximumMessageSize = 400
+
+	bob := testPeer(t, r, "bob")
+
+	rc := New()
+	rc.Opts = opts
+	testRoom(rc, "lobby")
+
+	events := make(chan Event, 64)
+	rc.On(GroupMessage, func(e Event) {
+		events <- e
+	})
+
+	r.Mp.Out(func(b []byte) {
+		rcv, err := bob.ReceiveMessage("bot", string(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rcv.Plaintext) > 0 {
+			rc.processGroupchatBytes("lobby", "bot", rcv.Plaintext, rcv.Recipients)
+		}
+	})
+
+	return r, events
+}
+
+func TestGroupLong(t *testing.T) {
+	var lines []string
+	for i := 0; i < 40; i++ {
+		lines = append(lines, strings.Repeat("report line ", 3))
+	}
+	text := strings.Join(lines, "\n")
+
+	r, events := longPair(t, Reassemble)
+	if err := r.GroupLong(text); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := <-events; e.Body != text || e.User != "bot" || len(e.Recipients) != 1 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// Without Reassemble, every chunk arrives on its own, numbered.
+	r, events = longPair(t, 0)
+	if err := r.GroupLong(text); err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(splitLines(text, r.Mp.MaxPlaintextSize()-len(chunkPrefix(maxChunks-1, maxChunks))))
+	var bodies []string
+	for i := 0; i < n; i++ {
+		bodies = append(bodies, (<-events).Body)
+	}
+	sort.Strings(bodies)
+	if n < 2 || !strings.HasPrefix(bodies[0], chunkPrefix(0, n)) {
+		t.Fatal("unexpected chunks", n, bodies)
+	}
+
+	if err := r.GroupLong(strings.Repeat("x", 400*maxChunks)); err != TooLong {
+		t.Fatal("expected TooLong, got", err)
+	}
+}
+
+func TestInterruptedLong(t *testing.T) {
+	r := testRoom(New(), "lobby")
+
+	r.expectLong("bob", 3)
+	if got := r.takeChunk("bob", chunkPrefix(0, 3)+"one\n"); got != nil {
+		t.Fatal("first chunk should be held", got)
+	}
+
+	// Text that is not the expected chunk ends the long message, and what had arrived of it is passed on.
+	got := r.takeChunk("bob", "hello")
+	if len(got) != 2 || got[0] != "one\n" || got[1] != "hello" {
+		t.Fatal("unexpected bodies", got)
+	}
+
+	if got := r.takeChunk("bob", chunkPrefix(1, 3)+"two"); len(got) != 1 {
+		t.Fatal("chunk without a marker should pass through", got)
+	}
+
+	// So does a new marker.
+	r.expectLong("bob", 3)
+	r.takeChunk("bob", chunkPrefix(0, 3)+"one\n")
+	r.expectLong("bob", 2)
+	if got := r.takeChunk("bob", chunkPrefix(0, 2)+"a"); got != nil {
+		t.Fatal("first chunk of the new message should be held", got)
+	}
+	if got := r.takeChunk("bob", chunkPrefix(1, 2)+"b"); len(got) != 1 || got[0] != "ab" {
+		t.Fatal("unexpected bodies", got)
+	}
+}
+
+func TestContinuationBEX(t *testing.T) {
+	b, err := DecodeBEX(EncodeBEX([]BEX{{Header: CONTINUATION, Chunks: 5}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != 1 || b[0].Chunks != 5 {
+		t.Fatalf("unexpected packets %+v", b)
+	}
+}
+
+func TestConcurrentLong(t *testing.T) {
+	rc := New()
+	rc.Opts = Reassemble
+	rr := testRoom(rc, "lobby")
+	rr.Mp, _ = multiparty.NewMe("bob", "")
+	rr.MyName = "bob"
+
+	events := make(chan Event, 8)
+	rc.On(GroupMessage, func(e Event) {
+		events <- e
+	})
+
+	// Two senders post long messages at once, and their stanzas go through the receive path as they arrive.
+	texts := make(map[string]string)
+	var wg sync.WaitGroup
+	for _, name := range []string{"alice", "carol"} {
+		r := testRoom(New(), "lobby")
+		r.Mp, _ = multiparty.NewMe(name, "")
+		r.Mp.MaximumMessageSize = 400
+		exchangeKeys(t, rr.Mp, r.Mp)
+
+		jid, _ := xmpp.MUCJID("lobby", "conference.crypto.dog", name)
+		r.Mp.Out(func(b []byte) {
+			rc.dispatch(xmpp.Message{Type: "groupchat", From: jid.String(), Body: string(b)})
+		})
+
+		texts[name] = strings.Repeat(name+" says hello\n", 60)
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+			if err := r.GroupLong(text); err != nil {
+				t.Error(err)
+			}
+		}(texts[name])
+	}
+	wg.Wait()
+
+	for n := len(texts); n > 0; n-- {
+		select {
+		case e := <-events:
+			if e.Body != texts[e.User] {
+				t.Fatalf("%s's long message arrived as %q", e.User, e.Body)
+			}
+			delete(texts, e.User)
+		case <-time.After(5 * time.Second):
+			t.Fatal("long messages were not delivered", texts)
+		}
+	}
+}
+
+func TestAbandonedLong(t *testing.T) {
+	c := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c.Clock = clock
+	r := testRoom(c, "lobby")
+
+	given := make(chan Event, maxLongSenders+4)
+	c.On(GroupMessage, func(e Event) {
+		given <- e
+	})
+
+	start := func(user string) {
+		r.expectLong(user, 3)
+		r.takeChunk(user, chunkPrefix(0, 3)+user)
+	}
+
+	// A sender leaving passes on what they had sent.
+	start("bob")
+	r.flushLong("bob")
+	if e := <-given; e.User != "bob" || e.Body != "bob" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// So does a long message taking too long.
+	start("carol")
+	clock.now = clock.now.Add(maxLongAge + time.Second)
+	r.takeChunk("dave", "hi")
+	if e := <-given; e.User != "carol" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// Only so many senders are buffered at once, and the oldest makes way.
+	for i := 0; i <= maxLongSenders; i++ {
+		clock.now = clock.now.Add(time.Second)
+		start(fmt.Sprint("user", i))
+	}
+	if e := <-given; e.User != "user0" || len(r.long) != maxLongSenders {
+		t.Fatalf("unexpected event %+v with %d buffered", e, len(r.long))
+	}
+
+	r.Destroy()
+	if len(r.long) != 0 {
+		t.Fatal("Destroy kept long messages", len(r.long))
+	}
+}
@@ -0,0 +1,110 @@
+package dog
+
+import (
+	"encoding/base64"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/superp00t/etc/yo"
+)
+
+// KeyChangePolicy decides what happens when a user announces a multiparty key that was never seen under their nickname before.
+type KeyChangePolicy int
+
+const (
+	// Accept the key and pin it alongside the old ones, emitting KeyChanged.
+	WarnKeyChange KeyChangePolicy = iota
+	// Refuse the key, emitting KeyChanged. Group messages from the user are rejected until they return with a pinned key or their pins are forgotten.
+	BlockKeyChange
+	// Accept and pin the key silently.
+	AcceptKeyChange
+)
+
+// pinKey names the record holding the fingerprints pinned for a nickname in a room, as a JSON list, oldest first.
+// Both names are encoded so that the key is also a safe file name for Disk_DB.
+func pinKey(room, nick string) string {
+	return "pins." + base64.RawURLEncoding.EncodeToString([]byte(room)) + "." + base64.RawURLEncoding.EncodeToString([]byte(nick))
+}
+
+// loadPins returns the fingerprints pinned for nick in room. pl must be held.
+func (c *Conn) loadPins(room, nick string) []string {
+	var fps []string
+	c.loadJSON(pinKey(room, nick), &fps)
+	return fps
+}
+
+// Pins returns every fingerprint seen for a nickname in a room, oldest first.
+func (c *Conn) Pins(room, nick string) []string {
+	c.pl.Lock()
+	defer c.pl.Unlock()
+	return c.loadPins(room, nick)
+}
+
+// ForgetPins removes the pinned fingerprints for a nickname, so that the next key they announce is trusted on first use again.
+func (c *Conn) ForgetPins(room, nick string) {
+	c.pl.Lock()
+	defer c.pl.Unlock()
+	c.DB.Delete(pinKey(room, nick))
+}
+
+// checkPin is consulted by multiparty before it accepts a key. It runs with the Me locked, so pl is always taken after the Me's lock.
+// Any KeyChanged event is queued rather than emitted, for emitKeyEvents to send once the Me is unlocked.
+func (r *Room) checkPin(nick string, publicKey [32]byte) bool {
+	c := r.c
+	fp := multiparty.FingerprintKey(publicKey[:])
+
+	c.pl.Lock()
+	defer c.pl.Unlock()
+
+	known := c.loadPins(r.Name, nick)
+	for _, v := range known {
+		if v == fp {
+			return true
+		}
+	}
+
+	accept := c.KeyChangePolicy != BlockKeyChange || len(known) == 0
+	if accept {
+		c.storeJSON(pinKey(r.Name, nick), append(known, fp))
+	}
+
+	if len(known) > 0 && c.KeyChangePolicy != AcceptKeyChange {
+		r.keyEvents = append(r.keyEvents, Event{
+			Type:                 KeyChanged,
+			User:                 nick,
+			Fingerprint:          fp,
+			PreviousFingerprints: known,
+		})
+	}
+
+	return accept
+}
+
+// emitKeyEvents emits the events queued by checkPin.
+func (r *Room) emitKeyEvents() {
+	r.c.pl.Lock()
+	events := r.keyEvents
+	r.keyEvents = nil
+	r.c.pl.Unlock()
+
+	for _, e := range events {
+		r.emit(e)
+	}
+}
+
+// changeKey handles a user who announces a new key in the middle of a session, under the same KeyChangePolicy as a first announcement.
+func (r *Room) changeKey(nick string, publicKey [32]byte) {
+	old, ok := r.Mp.BuddyKey(nick)
+	if !ok {
+		return
+	}
+
+	accept := r.checkPin(nick, publicKey)
+	r.emitKeyEvents()
+	if !accept {
+		return
+	}
+
+	if err := r.Mp.RotateBuddyKey(nick, old, publicKey); err != nil {
+		yo.L(4).Warn(err)
+	}
+}
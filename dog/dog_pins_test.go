@@ -0,0 +1,95 @@
+package dog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/Cryptodog/go-cryptodog/xmpp"
+)
+
+func TestCheckPin(t *testing.T) {
+	for _, policy := range []KeyChangePolicy{WarnKeyChange, BlockKeyChange, AcceptKeyChange} {
+		c := New()
+		c.KeyChangePolicy = policy
+		r := testRoom(c, "lobby")
+
+		changed := make(chan Event, 1)
+		c.On(KeyChanged, func(e Event) {
+			changed <- e
+		})
+
+		first, second := [32]byte{1}, [32]byte{2}
+
+		if !r.checkPin("bob", first) || !r.checkPin("bob", first) {
+			t.Fatal("first key should always be trusted")
+		}
+
+		accepted := r.checkPin("bob", second)
+		r.emitKeyEvents()
+		if accepted != (policy != BlockKeyChange) {
+			t.Fatal("policy", policy, "accepted =", accepted)
+		}
+
+		if policy != AcceptKeyChange {
+			e := <-changed
+			if e.User != "bob" || e.Room != "lobby" || len(e.PreviousFingerprints) != 1 || e.Fingerprint == e.PreviousFingerprints[0] {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		}
+
+		if n := len(c.Pins("lobby", "bob")); n != 1 && policy == BlockKeyChange || n != 2 && policy != BlockKeyChange {
+			t.Fatal("policy", policy, "left", n, "pins")
+		}
+
+		c.ForgetPins("lobby", "bob")
+		if !r.checkPin("bob", second) {
+			t.Fatal("key should be trusted after forgetting pins")
+		}
+	}
+}
+
+func TestChangeKey(t *testing.T) {
+	for _, policy := range []KeyChangePolicy{WarnKeyChange, BlockKeyChange, AcceptKeyChange} {
+		c := New()
+		c.KeyChangePolicy = policy
+		r := testRoom(c, "lobby")
+		r.Mp, _ = multiparty.NewMe("bot", "")
+		r.Mp.FilterKeys(r.checkPin)
+
+		changed := make(chan Event, 1)
+		c.On(KeyChanged, func(e Event) {
+			changed <- e
+		})
+
+		old := testPeer(t, r, "bob").Fingerprint("")
+
+		// Bob announces another key without leaving the room first.
+		next, _ := multiparty.NewMe("bob", "")
+		next.Out(func(b []byte) {
+			jid, _ := xmpp.MUCJID("lobby", "conference.crypto.dog", "bob")
+			c.processMessage(xmpp.Message{Type: "groupchat", From: jid.String(), Body: string(b)})
+		})
+		next.SendPublicKey("")
+
+		want := next.Fingerprint("")
+		if policy == BlockKeyChange {
+			want = old
+		}
+		if got := r.Mp.Fingerprint("bob"); got != want {
+			t.Fatal("policy", policy, "left bob with", got, "instead of", want)
+		}
+
+		if policy != AcceptKeyChange {
+			if e := <-changed; e.User != "bob" || e.Fingerprint != next.Fingerprint("") || e.PreviousFingerprints[0] != old {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		}
+
+		select {
+		case e := <-changed:
+			t.Fatalf("unexpected event %+v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
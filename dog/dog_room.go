@@ -1,7 +1,6 @@
 package dog
 
 import (
-	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"strings"
@@ -18,6 +17,7 @@ type Room struct {
 	Name             string
 	MyName           string
 	Mp               *multiparty.Me
+	Identity         IdentityPolicy
 	Members          map[string]*Member
 	ModerationTables map[string][]string
 
@@ -27,6 +27,15 @@ type Room struct {
 	bexAddTout  chan float64
 	bexTx       chan []BEX
 	joinedEvent bool
+	tr          *transcript
+	// KeyChanged events waiting to be emitted, guarded by c.pl. See checkPin.
+	keyEvents []Event
+	// Fingerprints in the "keys" moderation table, guarded by ml.
+	keyBans map[string]struct{}
+	// Long messages being reassembled, by sender, guarded by ml.
+	long map[string]*longMessage
+	// Held while sending a long message, so that its chunks are not interleaved with another's.
+	ll sync.Mutex
 }
 
 type Member struct {
@@ -41,13 +50,27 @@ func (m *Member) Name() string {
 	return m.nickname
 }
 
+// GetRoom returns the joined room called name, which is prepared the same way as when joining.
 func (c *Conn) GetRoom(name string) *Room {
+	name = roomName(name)
+
 	c.rl.Lock()
 	room := c.rooms[name]
 	c.rl.Unlock()
 	return room
 }
 
+// roomName returns the name a room is kept under: prepared as its JID would be, then unescaped.
+// Names that cannot be prepared are returned as they are, and match no room.
+func roomName(name string) string {
+	local, err := xmpp.PrepareRoom(name)
+	if err != nil {
+		return name
+	}
+
+	return xmpp.UnescapeLocal(local)
+}
+
 func (c *Conn) GM(room string, body string) {
 	if !utf8.ValidString(body) {
 		yo.Warn("invalid utf-8 string!")
@@ -63,18 +86,28 @@ func (c *Conn) GMf(room string, format string, args ...interface{}) {
 
 func (c *Conn) Group(room string, b []byte) {
 	if r := c.GetRoom(room); r != nil {
-		r.Group(b)
+		if err := r.Group(b); err != nil {
+			yo.Warn("Group", room, err)
+		}
 	} else {
 		yo.Warn("Group", room, "doesn't exist!")
 	}
 }
 
-func (r *Room) GM(body string) {
-	r.Group([]byte(body))
+func (r *Room) GM(body string) error {
+	return r.Group([]byte(body))
+}
+
+// Group sends a message to everyone in the room. Messages too large for peers to accept fail with multiparty.ErrMessageTooLarge.
+func (r *Room) Group(b []byte) error {
+	return r.Mp.SendMessage(b)
 }
 
-func (r *Room) Group(b []byte) {
-	r.Mp.SendMessage(b)
+// GroupTo sends a group message that only the named members can read, without opening OTR sessions.
+// Everyone in the room can see who it was for. Go-cryptodog members left out get an ExcludedGroupMessage event,
+// and recipients a PartialRecipients event naming those left out.
+func (r *Room) GroupTo(recipients []string, b []byte) error {
+	return r.Mp.SendMessageTo(recipients, b)
 }
 
 func (r *Room) DM(user, data string) {
@@ -82,13 +115,8 @@ func (r *Room) DM(user, data string) {
 }
 
 func (r *Room) IsMod(user string) bool {
-	for _, v := range r.c.GetMods() {
-		if v == r.GroupFingerprint(user) {
-			return true
-		}
-	}
-
-	return false
+	fp := r.GroupFingerprint(user)
+	return fp != "" && r.c.isModFingerprint(fp)
 }
 
 func (r *Room) GetMember(s string) *Member {
@@ -119,12 +147,14 @@ func (m *Member) DM(data string) {
 		yo.L(4).Warn(err)
 	}
 
+	to, err := m.r.jid(m.nickname)
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+
 	for _, v := range vm {
-		m.r.c.c.SendMessage(xmpp.JID{
-			Local: m.r.Name,
-			Host:  m.r.c.Conference,
-			Node:  m.nickname,
-		}.String(), "chat", string(v))
+		m.r.c.conn().SendMessage(to, "chat", string(v))
 	}
 }
 
@@ -146,7 +176,7 @@ func (m *Member) initOtr() {
 
 		m.otr = new(otr3.Conversation)
 		m.otr.SetOurKeys([]otr3.PrivateKey{key})
-		m.otr.Rand = rand.Reader
+		m.otr.Rand = m.r.c.rand()
 		m.otr.SetSMPEventHandler(m)
 		m.otr.SetMessageEventHandler(m)
 		m.otr.SetSecurityEventHandler(m)
@@ -156,8 +186,23 @@ func (m *Member) initOtr() {
 	}
 }
 
+// Destroy stops using the room and wipes its multiparty keys.
 func (r *Room) Destroy() {
 	r.killed = true
+	r.flushLong("")
+	if r.Mp != nil {
+		r.Mp.Shutdown()
+	}
+}
+
+// jid returns the address of the room, or of one of its occupants.
+func (r *Room) jid(nick string) (string, error) {
+	j, err := xmpp.MUCJID(r.Name, r.c.Conference, nick)
+	if err != nil {
+		return "", err
+	}
+
+	return j.String(), nil
 }
 
 func (r *Room) emit(e Event) {
@@ -166,11 +211,14 @@ func (r *Room) emit(e Event) {
 }
 
 func (r *Room) transmitMp(b []byte) {
-	r.c.c.SendMessage(
-		xmpp.JID{
-			Local: r.Name,
-			Host:  r.c.Conference,
-		}.String(),
+	to, err := r.jid("")
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+
+	r.c.conn().SendMessage(
+		to,
 		"groupchat",
 		string(b),
 	)
@@ -306,12 +354,14 @@ func (m *Member) Raw(str string) {
 		return
 	}
 
-	if err := m.r.c.c.SendMessage(
-		xmpp.JID{
-			Local: m.r.Name,
-			Host:  m.r.c.Conference,
-			Node:  m.nickname,
-		}.String(),
+	to, err := m.r.jid(m.nickname)
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+
+	if err := m.r.c.conn().SendMessage(
+		to,
 		"chat",
 		str,
 	); err != nil {
@@ -369,11 +419,12 @@ func (m *Room) SendXGroupComposing() {
 		yo.Warn("room is nil")
 		return
 	}
-	m.c.c.SendComposing(xmpp.JID{
-		Local: m.Name,
-		Host:  m.c.Conference,
-	}.String(),
-		"groupchat")
+	to, err := m.jid("")
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+	m.c.conn().SendComposing(to, "groupchat")
 }
 
 func (m *Room) SendXGroupPaused() {
@@ -381,11 +432,12 @@ func (m *Room) SendXGroupPaused() {
 		yo.Warn("room is nil")
 		return
 	}
-	m.c.c.SendPaused(xmpp.JID{
-		Local: m.Name,
-		Host:  m.c.Conference,
-	}.String(),
-		"groupchat")
+	to, err := m.jid("")
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+	m.c.conn().SendPaused(to, "groupchat")
 }
 
 func (m *Room) SendXPrivateComposing(target string) {
@@ -393,12 +445,12 @@ func (m *Room) SendXPrivateComposing(target string) {
 		yo.Warn("room is nil")
 		return
 	}
-	m.c.c.SendComposing(xmpp.JID{
-		Local: m.Name,
-		Host:  m.c.Conference,
-		Node:  target,
-	}.String(),
-		"chat")
+	to, err := m.jid(target)
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+	m.c.conn().SendComposing(to, "chat")
 }
 
 func (m *Room) SendXPrivatePaused(target string) {
@@ -406,12 +458,35 @@ func (m *Room) SendXPrivatePaused(target string) {
 		yo.Warn("room is nil")
 		return
 	}
-	m.c.c.SendPaused(xmpp.JID{
-		Local: m.Name,
-		Host:  m.c.Conference,
-		Node:  target,
-	}.String(),
-		"chat")
+	to, err := m.jid(target)
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+	m.c.conn().SendPaused(to, "chat")
+}
+
+// Sends an XEP-0085 chat state via XMPP, to the whole room if target is empty.
+func (m *Room) SendXChatState(target string, state xmpp.ChatState) {
+	if m == nil {
+		yo.Warn("room is nil")
+		return
+	}
+
+	typeof := "chat"
+	if target == "" {
+		typeof = "groupchat"
+	}
+
+	to, err := m.jid(target)
+	if err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+
+	if err := m.c.conn().SendChatState(to, typeof, state); err != nil {
+		yo.L(4).Warn(err)
+	}
 }
 
 func (m *Room) GetUsernames() []string {
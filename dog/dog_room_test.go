@@ -0,0 +1,99 @@
+package dog
+
+import (
+	"testing"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/Cryptodog/go-cryptodog/xmpp"
+)
+
+func TestModerationLookups(t *testing.T) {
+	c := New()
+	r := testRoom(c, "lobby")
+	r.Mp, _ = multiparty.NewMe("bot", "")
+
+	bob := testPeer(t, r, "bob")
+	fp := bob.Fingerprint("")
+
+	if r.IsMod("bob") || r.IsBlocked("bob") {
+		t.Fatal("bob should start out as a regular member")
+	}
+
+	c.SetMods([]string{fp})
+	if !r.IsMod("bob") || r.IsMod("nobody") {
+		t.Fatal("moderator lookup failed")
+	}
+
+	r.SetModerationTable("keys", []string{fp})
+	if !r.IsBlocked("bob") {
+		t.Fatal("banned key was not blocked")
+	}
+}
+
+func TestExcludedGroupMessage(t *testing.T) {
+	c := New()
+	r := testRoom(c, "lobby")
+	r.Mp, _ = multiparty.NewMe("bot", "")
+
+	bob := testPeer(t, r, "bob")
+	carol, _ := multiparty.NewMe("carol", "")
+	exchangeKeys(t, bob, carol)
+
+	resyncs := 0
+	r.Mp.Out(func([]byte) {
+		resyncs++
+	})
+
+	events := make(chan Event, 2)
+	c.On(Any, func(e Event) {
+		events <- e
+	})
+
+	deliver := func(from string, m *multiparty.Me, send func() error) {
+		m.Out(func(b []byte) {
+			jid, _ := xmpp.MUCJID("lobby", "conference.example.com", from)
+			c.processMessage(xmpp.Message{Type: "groupchat", From: jid.String(), Body: string(b)})
+		})
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Left out on purpose by someone we share a key with.
+	deliver("bob", bob, func() error {
+		return bob.SendMessageTo([]string{"carol"}, []byte("not for bot"))
+	})
+	if e := <-events; e.Type != ExcludedGroupMessage || e.User != "bob" || len(e.Recipients) != 1 || e.Recipients[0] != "carol" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if resyncs != 0 {
+		t.Fatal("being left out should not resync")
+	}
+
+	// Carol has never announced a key to us, so we ask for it.
+	deliver("carol", carol, func() error {
+		return carol.SendMessage([]byte("hello bob"))
+	})
+	if e := <-events; e.Type != InvalidGroupMessage || e.User != "carol" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if resyncs == 0 {
+		t.Fatal("a sender without a shared key should be resynced")
+	}
+}
+
+func TestRoomNames(t *testing.T) {
+	c := New()
+	r := testRoom(c, roomName("Lobby"))
+
+	for _, name := range []string{"Lobby", "lobby", "LOBBY"} {
+		if c.GetRoom(name) != r {
+			t.Fatal("no room found for", name)
+		}
+	}
+
+	// Without a conference there is no address to send to.
+	if _, err := r.jid(""); err == nil {
+		t.Fatal("expected an error for a missing conference")
+	}
+}
@@ -0,0 +1,167 @@
+package dog
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/superp00t/etc/yo"
+)
+
+// RotateKeys replaces the multiparty key of every joined room.
+// Each room announces the new key with a KEY_ROTATION packet encrypted and authenticated under the old key,
+// so go-cryptodog peers that pinned the old key accept the new one without a KeyChanged warning.
+// Rooms sharing the global identity all move to the same new key.
+//
+// The web client and other peers that are not go-cryptodog do not understand KEY_ROTATION. To them the new key
+// is a key change, and the secret they shared with us is lost: they may warn about the change or stop reading our messages.
+func (c *Conn) RotateKeys() error {
+	if c.conn() == nil {
+		return fmt.Errorf("dog: cannot rotate keys while disconnected")
+	}
+
+	global := c.newSecret()
+
+	c.pl.Lock()
+	keys := make(map[string]string)
+	c.loadJSON("roomkeys", &keys)
+	c.pl.Unlock()
+
+	// The rotations are sent once rl is released, so that a slow connection does not hold up the rooms.
+	type rotation struct {
+		room   *Room
+		secret string
+	}
+	var rotations []rotation
+
+	c.rl.Lock()
+	for name, r := range c.rooms {
+		var secret string
+		switch r.Identity {
+		case GlobalIdentity:
+			secret = global
+		case RoomIdentity:
+			secret = c.newSecret()
+			keys[name] = secret
+		case EphemeralIdentity:
+			secret = c.newSecret()
+		}
+
+		rotations = append(rotations, rotation{r, secret})
+	}
+	c.rl.Unlock()
+
+	for _, rt := range rotations {
+		rt.room.rotate(rt.secret)
+	}
+
+	c.pl.Lock()
+	c.storeString("mp", global)
+	c.storeJSON("roomkeys", keys)
+	c.storeJSON("rotated", c.clock().Now())
+	c.pl.Unlock()
+	return nil
+}
+
+// rotate announces a new key under the old one, then switches to it.
+// Stanzas from one sender are handled in order, so peers apply the KEY_ROTATION before they see the new key announced.
+func (r *Room) rotate(secret string) {
+	b, _ := base64.StdEncoding.DecodeString(secret)
+	var sk [32]byte
+	copy(sk[:], b)
+	wipeBytes(b)
+	pk := multiparty.DerivePublicKey(sk)
+
+	r.SendBEXGroup([]BEX{
+		{
+			Header:    KEY_ROTATION,
+			PublicKey: pk[:],
+		},
+	})
+
+	r.Mp.SetSecretKey(sk)
+	wipeBytes(sk[:])
+	r.Mp.SendPublicKey("")
+}
+
+// rotateKeysEvery runs RotateKeys whenever KeyRotationInterval has passed since the last rotation, until the connection is killed.
+func (c *Conn) rotateKeysEvery(interval time.Duration) {
+	for {
+		var last time.Time
+		c.pl.Lock()
+		c.loadJSON("rotated", &last)
+		if last.IsZero() {
+			last = c.clock().Now()
+			c.storeJSON("rotated", last)
+		}
+		c.pl.Unlock()
+
+		// Give rooms time to exchange keys after connecting, so that peers can verify the rotation.
+		wait := interval - c.clock().Now().Sub(last)
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		c.clock().Sleep(wait)
+
+		if c.isKilled() {
+			return
+		}
+
+		if err := c.RotateKeys(); err != nil {
+			yo.L(4).Warn(err)
+		}
+	}
+}
+
+// acceptRotation handles a KEY_ROTATION packet. Since it arrived in a group message that decrypted under the sender's current key,
+// the new key is vouched for by the old one. It is only accepted if the old key is pinned.
+func (r *Room) acceptRotation(from string, publicKey []byte) {
+	if len(publicKey) != 32 {
+		return
+	}
+
+	var pk [32]byte
+	copy(pk[:], publicKey)
+
+	oldKey, ok := r.Mp.BuddyKey(from)
+	if !ok {
+		return
+	}
+
+	old := multiparty.FingerprintKey(oldKey[:])
+	fp := multiparty.FingerprintKey(pk[:])
+
+	c := r.c
+	c.pl.Lock()
+	pinned := false
+	for _, v := range c.loadPins(r.Name, from) {
+		if v == old {
+			pinned = true
+			break
+		}
+	}
+	c.pl.Unlock()
+
+	if !pinned {
+		yo.L(4).Warn(from, "rotated an unpinned key")
+		return
+	}
+
+	// pl must not be held here, since checkPin takes it with the Me locked.
+	if err := r.Mp.RotateBuddyKey(from, oldKey, pk); err != nil {
+		yo.L(4).Warn(err)
+		return
+	}
+
+	c.pl.Lock()
+	c.storeJSON(pinKey(r.Name, from), append(c.loadPins(r.Name, from), fp))
+	c.pl.Unlock()
+
+	r.emit(Event{
+		Type:                 KeyRotated,
+		User:                 from,
+		Fingerprint:          fp,
+		PreviousFingerprints: []string{old},
+	})
+}
@@ -0,0 +1,144 @@
+package dog
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/Cryptodog/go-cryptodog/xmpp"
+)
+
+func TestAcceptRotation(t *testing.T) {
+	c := New()
+	r := testRoom(c, "lobby")
+	r.Mp, _ = multiparty.NewMe("bot", "")
+	r.Mp.FilterKeys(r.checkPin)
+
+	rotated := make(chan Event, 1)
+	c.On(KeyRotated, func(e Event) {
+		rotated <- e
+	})
+
+	testPeer(t, r, "bob")
+
+	old := r.Mp.Fingerprint("bob")
+	next, _ := multiparty.NewMe("bob", "")
+
+	// Bob's old key was pinned on first use, so the rotation is trusted.
+	r.acceptRotation("bob", next.PublicKey[:])
+
+	e := <-rotated
+	if e.User != "bob" || e.Fingerprint != next.Fingerprint("") || e.PreviousFingerprints[0] != old {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	if r.Mp.Fingerprint("bob") != e.Fingerprint {
+		t.Fatal("rotation was not applied")
+	}
+
+	if pins := c.Pins("lobby", "bob"); len(pins) != 2 || pins[1] != e.Fingerprint {
+		t.Fatal("rotated key was not pinned", pins)
+	}
+
+	// Without a pin for the current key, a rotation is ignored.
+	c.ForgetPins("lobby", "bob")
+	third, _ := multiparty.NewMe("bob", "")
+	r.acceptRotation("bob", third.PublicKey[:])
+	if r.Mp.Fingerprint("bob") != e.Fingerprint {
+		t.Fatal("rotation of an unpinned key was applied")
+	}
+}
+
+func TestKeyRotationBEX(t *testing.T) {
+	pk := bytes.Repeat([]byte{7}, 32)
+	b, err := DecodeBEX(EncodeBEX([]BEX{{Header: KEY_ROTATION, PublicKey: pk}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != 1 || b[0].Header != KEY_ROTATION || !bytes.Equal(b[0].PublicKey, pk) {
+		t.Fatalf("unexpected packets %+v", b)
+	}
+}
+
+// fakeClock records sleeps and advances its time by them instead of waiting.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Sleep(d time.Duration) {
+	f.slept = append(f.slept, d)
+	f.now = f.now.Add(d)
+}
+
+func TestRotationSchedule(t *testing.T) {
+	clk := &fakeClock{now: time.Now()}
+	c := New()
+	c.DB = new(sync.Map)
+	c.Clock = clk
+	c.killed = true
+
+	// The last rotation was 50 minutes ago, so the next one is due in 10.
+	c.storeJSON("rotated", clk.now.Add(-50*time.Minute))
+	c.rotateKeysEvery(time.Hour)
+
+	if len(clk.slept) != 1 || clk.slept[0] != 10*time.Minute {
+		t.Fatal("unexpected wait", clk.slept)
+	}
+
+	// An overdue rotation still waits a minute, to let keys be exchanged first.
+	clk.slept = nil
+	c.storeJSON("rotated", clk.now.Add(-2*time.Hour))
+	c.rotateKeysEvery(time.Hour)
+
+	if len(clk.slept) != 1 || clk.slept[0] != time.Minute {
+		t.Fatal("unexpected wait", clk.slept)
+	}
+}
+
+func TestRotationOrder(t *testing.T) {
+	c := New()
+	r := testRoom(c, "lobby")
+	r.Mp, _ = multiparty.NewMe("bot", "")
+	r.Mp.FilterKeys(r.checkPin)
+
+	got := make(chan Event, 1)
+	c.On(GroupMessage, func(e Event) {
+		got <- e
+	})
+	c.On(InvalidGroupMessage, func(e Event) {
+		t.Error("message under the new key was rejected")
+	})
+
+	bob := testPeer(t, r, "bob")
+	next, _ := multiparty.NewMe("bob", "")
+
+	// Bob rotates and speaks under the new key straight away. Both stanzas arrive before either is processed.
+	jid, _ := xmpp.MUCJID("lobby", "conference.crypto.dog", "bob")
+	bob.Out(func(b []byte) {
+		c.dispatch(xmpp.Message{Type: "groupchat", From: jid.String(), Body: string(b)})
+	})
+	bob.SendMessage(EncodeBEX([]BEX{{Header: KEY_ROTATION, PublicKey: next.PublicKey[:]}}))
+	bob.SetSecretKey(next.SecretKey)
+	bob.SendMessage([]byte("after"))
+
+	select {
+	case e := <-got:
+		if e.Body != "after" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message under the new key was not delivered")
+	}
+
+	if r.Mp.Fingerprint("bob") != next.Fingerprint("") {
+		t.Fatal("rotation was not applied")
+	}
+}
@@ -0,0 +1,161 @@
+package dog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+	"github.com/Cryptodog/go-cryptodog/xmpp"
+)
+
+const (
+	DefaultTranscriptInterval = 25
+
+	// Largest checkpoint we send or accept.
+	maxTranscriptWindow = 512
+	// How many message tags each room remembers, so that checkpoints from slower members can still be matched.
+	transcriptHistory = 4 * maxTranscriptWindow
+)
+
+// transcript is the sequence of multiparty message tags seen in a room, in the order the server delivered them.
+//
+// With the TranscriptCheck option, every TranscriptInterval messages the bot sends a TRANSCRIPT_HASH checkpoint:
+// the tag of the first message since its previous checkpoint (the anchor), and a rolling hash after each message from the anchor onwards.
+// Other members recompute the hashes from the same anchor over their own transcript.
+// The first hash that differs shows where the server delivered something different to them.
+type transcript struct {
+	l      sync.Mutex
+	tags   []string
+	window int
+}
+
+// add appends a tag. Once the current window reaches interval messages, it is closed and returned for checkpointing.
+func (t *transcript) add(tag string, interval int) []string {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	t.tags = append(t.tags, tag)
+
+	if over := len(t.tags) - transcriptHistory; over > 0 {
+		t.tags = t.tags[:copy(t.tags, t.tags[over:])]
+		t.window -= over
+		if t.window < 0 {
+			t.window = 0
+		}
+	}
+
+	if len(t.tags)-t.window < interval {
+		return nil
+	}
+
+	window := append([]string(nil), t.tags[t.window:]...)
+	t.window = len(t.tags)
+	return window
+}
+
+// since returns up to n tags starting at the most recent occurrence of anchor, or nil if the anchor is unknown.
+func (t *transcript) since(anchor string, n int) []string {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	for i := len(t.tags) - 1; i >= 0; i-- {
+		if t.tags[i] == anchor {
+			end := i + n
+			if end > len(t.tags) {
+				end = len(t.tags)
+			}
+			return append([]string(nil), t.tags[i:end]...)
+		}
+	}
+
+	return nil
+}
+
+// chainHashes returns the rolling hash after each tag, truncated to 64 bits.
+func chainHashes(tags []string) []string {
+	var hashes []string
+	var state []byte
+
+	for _, v := range tags {
+		h := sha256.New()
+		h.Write(state)
+		h.Write([]byte(v))
+		state = h.Sum(nil)
+
+		hashes = append(hashes, hex.EncodeToString(state[:8]))
+	}
+
+	return hashes
+}
+
+func (c *Conn) transcriptInterval() int {
+	switch {
+	case c.TranscriptInterval <= 0:
+		return DefaultTranscriptInterval
+	case c.TranscriptInterval > maxTranscriptWindow:
+		return maxTranscriptWindow
+	}
+
+	return c.TranscriptInterval
+}
+
+// recordTranscript must be called in the order messages arrive from the server, before any concurrent processing.
+// It uses the tag in the clear, so messages that were not encrypted for us still count.
+func (c *Conn) recordTranscript(msg xmpp.Message) {
+	jid, err := xmpp.ParseJID(msg.From)
+	if err != nil {
+		return
+	}
+
+	rm := c.GetRoom(xmpp.UnescapeLocal(jid.Local))
+	if rm == nil {
+		return
+	}
+
+	var ans multiparty.Answer
+	if err := json.Unmarshal([]byte(msg.Body), &ans); err != nil || ans.Type != "message" || ans.Tag == "" {
+		return
+	}
+
+	if window := rm.tr.add(ans.Tag, c.transcriptInterval()); window != nil {
+		go rm.SendBEXGroup([]BEX{
+			{
+				Header: TRANSCRIPT_HASH,
+				Anchor: window[0],
+				Hashes: chainHashes(window),
+			},
+		})
+	}
+}
+
+func (r *Room) checkTranscript(from, anchor string, theirs []string) {
+	if len(theirs) == 0 {
+		return
+	}
+
+	// Either they know of messages from before we joined, or we never got their anchor.
+	// The two cannot be told apart, so wait for the next checkpoint.
+	tags := r.tr.since(anchor, len(theirs))
+	if tags == nil {
+		return
+	}
+
+	ours := chainHashes(tags)
+	for i := range theirs {
+		if i >= len(ours) || ours[i] != theirs[i] {
+			// The first hash covers only the anchor, so a checkpoint that gets it wrong is malformed.
+			if i == 0 {
+				return
+			}
+
+			r.emit(Event{
+				Type: TranscriptMismatch,
+				User: from,
+				Body: tags[i-1],
+			})
+			return
+		}
+	}
+}
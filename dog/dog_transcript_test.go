@@ -0,0 +1,90 @@
+package dog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTranscriptWindows(t *testing.T) {
+	tr := new(transcript)
+
+	for i := 0; i < 4; i++ {
+		if w := tr.add(fmt.Sprint("tag", i), 5); w != nil {
+			t.Fatal("window closed early", w)
+		}
+	}
+
+	w := tr.add("tag4", 5)
+	if len(w) != 5 || w[0] != "tag0" || w[4] != "tag4" {
+		t.Fatal("unexpected window", w)
+	}
+
+	if got := tr.since("tag3", 10); len(got) != 2 || got[1] != "tag4" {
+		t.Fatal("unexpected tags since anchor", got)
+	}
+
+	if tr.since("unknown", 10) != nil {
+		t.Fatal("unknown anchor should return nil")
+	}
+
+	for i := 0; i < transcriptHistory; i++ {
+		tr.add(fmt.Sprint("more", i), maxTranscriptWindow)
+	}
+
+	if len(tr.tags) != transcriptHistory || tr.since("tag0", 1) != nil {
+		t.Fatal("history should be bounded")
+	}
+}
+
+func TestCheckTranscript(t *testing.T) {
+	c := New()
+	c.Opts = TranscriptCheck
+	r := testRoom(c, "lobby")
+
+	mismatch := make(chan Event, 1)
+	c.On(TranscriptMismatch, func(e Event) {
+		mismatch <- e
+	})
+
+	theirs := []string{"a", "b", "c", "d"}
+	for _, v := range []string{"x", "a", "b", "forged", "d"} {
+		r.tr.add(v, DefaultTranscriptInterval)
+	}
+
+	r.checkTranscript("bob", "a", chainHashes(theirs[:2]))
+	select {
+	case e := <-mismatch:
+		t.Fatal("unexpected mismatch", e)
+	default:
+	}
+
+	r.checkTranscript("bob", "a", chainHashes(theirs))
+	e := <-mismatch
+	if e.User != "bob" || e.Room != "lobby" || e.Body != "b" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	if a, b := chainHashes([]string{"a", "b"}), chainHashes([]string{"a", "c", "b"}); a[0] != b[0] || a[1] == b[1] {
+		t.Fatal("hashes should only agree up to the first difference")
+	}
+}
+
+func TestTranscriptHashBEX(t *testing.T) {
+	b, err := DecodeBEX(EncodeBEX([]BEX{{Header: TRANSCRIPT_HASH, Anchor: "a", Hashes: []string{"x", "y"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != 1 || b[0].Anchor != "a" || len(b[0].Hashes) != 2 || b[0].Hashes[1] != "y" {
+		t.Fatalf("unexpected packets %+v", b)
+	}
+
+	// A window longer than allowed must not have its hashes read as packets of their own.
+	hashes := make([]string, maxTranscriptWindow+1)
+	for i := range hashes {
+		hashes[i] = string([]byte{byte(MOD_ELECTED), 0})
+	}
+	if _, err := DecodeBEX(EncodeBEX([]BEX{{Header: TRANSCRIPT_HASH, Hashes: hashes}})); err == nil {
+		t.Fatal("over-long transcript window was accepted")
+	}
+}
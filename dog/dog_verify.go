@@ -0,0 +1,42 @@
+package dog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+)
+
+var CannotDM = errors.New("dog: direct messages are disabled")
+
+// VerificationCode describes how a member can verify our multiparty key out of band:
+// our fingerprint as PGP words, and the short authentication string we share with them.
+func (r *Room) VerificationCode(user string) (string, error) {
+	sas, err := r.Mp.SAS(user)
+	if err != nil {
+		return "", err
+	}
+
+	words, err := multiparty.FingerprintWords(r.Mp.Fingerprint(""))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("My fingerprint reads: %s\nOur verification code is: %s", strings.Join(words, " "), sas), nil
+}
+
+// SendVerification sends a member their VerificationCode over OTR.
+func (r *Room) SendVerification(user string) error {
+	if r.c.opt(DMDisabled) {
+		return CannotDM
+	}
+
+	code, err := r.VerificationCode(user)
+	if err != nil {
+		return err
+	}
+
+	r.DM(user, code)
+	return nil
+}
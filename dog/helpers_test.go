@@ -0,0 +1,53 @@
+package dog
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Cryptodog/go-cryptodog/multiparty"
+)
+
+// testRoom adds a room named name to c as if it had been joined.
+func testRoom(c *Conn, name string) *Room {
+	if c.DB == nil {
+		c.DB = new(sync.Map)
+	}
+
+	r := &Room{
+		Name:             name,
+		ModerationTables: make(map[string][]string),
+		Members:          make(map[string]*Member),
+		ml:               new(sync.Mutex),
+		tr:               new(transcript),
+		c:                c,
+	}
+	c.rooms[name] = r
+	return r
+}
+
+// exchangeKeys has a and b announce their public keys to each other. Out is left capturing, so set it afterwards.
+func exchangeKeys(t testing.TB, a, b *multiparty.Me) {
+	var out []byte
+	capture := func(d []byte) {
+		out = d
+	}
+
+	for _, pair := range [][2]*multiparty.Me{{a, b}, {b, a}} {
+		pair[0].Out(capture)
+		pair[0].SendPublicKey("")
+		if _, err := pair[1].ReceiveMessage(pair[0].Name, string(out)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testPeer returns the multiparty session of another member of r, who has exchanged keys with us.
+func testPeer(t testing.TB, r *Room, name string) *multiparty.Me {
+	me, err := multiparty.NewMe(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchangeKeys(t, r.Mp, me)
+	return me
+}
@@ -0,0 +1,48 @@
+package multiparty
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+var (
+	fuzzAlice = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	fuzzBob   = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+// fuzzPair returns alice and bob after they have exchanged keys. Whatever they send afterwards stays queued in the testNet.
+func fuzzPair(tb testing.TB) *testNet {
+	n := newTestNet(tb)
+	n.joinSecret("alice", fuzzAlice)
+	n.joinSecret("bob", fuzzBob)
+	n.flush()
+	return n
+}
+
+func FuzzReceiveMessage(f *testing.F) {
+	n := fuzzPair(f)
+	alice := n.members["alice"]
+	alice.SendMessage([]byte("hello"))
+	alice.SendMessage(nil)
+	alice.RequestPublicKey("bob")
+	for _, p := range n.queue {
+		f.Add(string(p.data))
+	}
+
+	f.Add(`{"type":"message","text":{"bob":{"message":"","iv":"","hmac":""},"carol":null},"tag":""}`)
+	f.Add(`{"type":"public_key","text":null}`)
+	f.Add(`{"type":"public_key_request","text":{}}`)
+
+	f.Fuzz(func(t *testing.T, message string) {
+		bob := fuzzPair(t).members["bob"]
+
+		rcv, err := bob.ReceiveMessage("alice", message)
+		if err == nil && rcv.Kind == Payload && rcv.Plaintext == nil {
+			t.Fatal("payload without plaintext")
+		}
+
+		// A stranger takes a different path through the key exchange.
+		bob.ReceiveMessage("mallory", message)
+	})
+}
@@ -1,10 +1,12 @@
 //Package multiparty implements the Cryptodog Multiparty Protocol as used in Cryptodog version 2.5.0, and previously, Cryptocat 2.
+//
+// Replayed messages are recognised by their IVs, which each Me remembers in its Replay cache. Messages carry no time of their own,
+// so once the cache has forgotten an IV, after DefaultReplayWindow or DefaultReplayMaxPerSender newer IVs from the same sender,
+// a captured copy of its message is accepted again as if it were new. Raise the cache's Window and MaxPerSender to narrow this.
 package multiparty
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -12,6 +14,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
@@ -50,12 +53,57 @@ type Buddy struct {
 	PublicKey     [32]byte
 	MpSecretKey   *MPStorage
 	HMAC          string
+	// Computed once, when PublicKey is accepted.
+	Fingerprint string
 }
 
+// KeyFilter decides whether a buddy's first public key announcement is accepted.
+// It is called while the Me is locked, so it must not call back into it.
+type KeyFilter func(nick string, publicKey [32]byte) bool
+
+// Clock tells the time. Tests can supply their own to control expiry and throttling.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to the Clock interface.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the Clock used when none is set.
+var SystemClock Clock = ClockFunc(time.Now)
+
+// Minimum time between two resyncs with the same buddy.
+const DefaultResyncInterval = 30 * time.Second
+
+// Largest ciphertext for one recipient, in base64 characters, that ReceiveMessage will decrypt and SendMessage will produce when MaximumMessageSize is not set.
+const DefaultMaximumMessageSize = 6000
+
+// Me is our side of a multiparty session. It is safe for concurrent use.
+//
+// buddyLock guards everything that changes after NewMe: Buddies and the Buddy values in it, our keys and fingerprints, keyMap, keyFilter, shutdown and the function set by Out.
+// keyLock guards blacklist. It may be taken while buddyLock is held, but never the other way around.
+// The Replay cache has a lock of its own and takes no other.
+//
+// The KeyFilter is called with buddyLock held, so it must not call back into the Me.
+// Messages are built under buddyLock but handed to the function set by Out after it is released, since sending may block on the network.
+// Messages sent from different goroutines may therefore reach that function in a different order than they were built.
+// Reading the exported fields directly is only safe before the Me is shared; use GetBuddy, GetPublicKey and SortedNames afterwards.
+// MaximumMessageSize, ResyncInterval, Name, Rand, Clock and Padding are configuration, and must not be changed once the Me is in use.
+//
+// Rand is the source of keys, IVs and padding, and defaults to crypto/rand.Reader. NewMe always generates keys from crypto/rand; call GenerateKeys after setting Rand to replace them.
+// Clock is used to throttle resyncs, and defaults to SystemClock. The Replay cache has a Clock of its own.
 type Me struct {
 	MaximumMessageSize int
+	ResyncInterval     time.Duration
 	Name               string
-	UsedIVs            []string
+	Rand               io.Reader
+	Clock              Clock
+	Padding            PaddingPolicy
+	Replay             *ReplayCache
 	SecretKey          [32]byte
 	PublicKey          [32]byte
 	SentKey            bool
@@ -66,6 +114,10 @@ type Me struct {
 	keyLock            sync.Mutex
 	keyMap             map[string]*time.Time
 	blacklist          map[string]bool
+	keyFilter          KeyFilter
+	shutdown           bool
+	fingerprint        string
+	byFingerprint      map[string]map[string]struct{}
 }
 
 func (m *Me) lock() {
@@ -76,6 +128,22 @@ func (me *Me) unlock() {
 	me.buddyLock.Unlock()
 }
 
+func (me *Me) rand() io.Reader {
+	if me.Rand != nil {
+		return me.Rand
+	}
+
+	return rand.Reader
+}
+
+func (me *Me) now() time.Time {
+	if me.Clock != nil {
+		return me.Clock.Now()
+	}
+
+	return SystemClock.Now()
+}
+
 func Sha512(input []byte) []byte {
 	hasher := sha512.New()
 	hasher.Write(input)
@@ -101,8 +169,10 @@ func MessageTag(message []byte) string {
 }
 
 func (me *Me) GenerateKeys() {
-	io.ReadFull(rand.Reader, me.SecretKey[:])
-	curve25519.ScalarBaseMult(&me.PublicKey, &me.SecretKey)
+	me.lock()
+	io.ReadFull(me.rand(), me.SecretKey[:])
+	me.derivePublicKey()
+	me.unlock()
 }
 
 func (me *Me) BlacklistUser(nick string) {
@@ -118,13 +188,37 @@ func (me *Me) UnblacklistUser(nick string) {
 }
 
 func (me *Me) SendPublicKey(nick string) {
+	me.lock()
+	msg := me.publicKeyMessage()
+	send := me._sendFunc
+	me.unlock()
+
+	transmit(send, msg)
+}
+
+// publicKeyMessage returns the announcement of our public key, or nil once shut down.
+func (me *Me) publicKeyMessage() []byte {
+	if me.shutdown {
+		return nil
+	}
+
 	a := KeyExMessage{
 		Type: "public_key",
 		Text: base64.StdEncoding.EncodeToString(me.PublicKey[:]),
 	}
 
 	str, _ := json.Marshal(a)
-	me._sendFunc(str)
+	return str
+}
+
+// transmit hands messages built under buddyLock to send, the function set by Out, skipping nil ones.
+// It must be called after buddyLock is released.
+func transmit(send func([]byte), msgs ...[]byte) {
+	for _, v := range msgs {
+		if v != nil {
+			send(v)
+		}
+	}
 }
 
 func HMAC(msg, key []byte) string {
@@ -133,14 +227,31 @@ func HMAC(msg, key []byte) string {
 	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
-func (me *Me) sendMessage(message []byte) {
-	buf := make([]byte, 64)
-	rand.Read(buf)
-	message = append(message, buf...)
+// Draws of an IV that may collide with one already sent before giving up.
+const maxIVAttempts = 4
+
+// encryptMessage encrypts message for every buddy with a key, or only those in recipients if it is not nil.
+// It returns nil once shut down.
+//
+// Each buddy's ciphertext and IV are laid out back to back in one buffer, which is exactly what the HMACs cover,
+// so the AES and HMAC work for each buddy can run in parallel without copying.
+func (me *Me) encryptMessage(message []byte, recipients []string) ([]byte, error) {
+	if me.shutdown {
+		return nil, nil
+	}
 
-	encrypted := Answer{
-		Type: "message",
-		Text: make(map[string]*TextAnswer),
+	// Pad a copy, so that the caller's slice is left alone and the copy can be wiped.
+	padded, err := me.pad(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var want map[string]bool
+	if recipients != nil {
+		want = make(map[string]bool, len(recipients))
+		for _, v := range recipients {
+			want[v] = true
+		}
 	}
 
 	var sortedRecipients []string
@@ -150,7 +261,10 @@ func (me *Me) sendMessage(message []byte) {
 		if me.blacklist[k] {
 			continue
 		}
-		if v.CryptoEnabled {
+		if want != nil && !want[k] {
+			continue
+		}
+		if v.CryptoEnabled && v.MpSecretKey != nil {
 			sortedRecipients = append(sortedRecipients, k)
 		}
 	}
@@ -158,82 +272,177 @@ func (me *Me) sendMessage(message []byte) {
 
 	sort.Strings(sortedRecipients)
 
-	var bhmac []byte
+	n := len(sortedRecipients)
+	stride := len(padded) + 12
 
-	for _, v := range sortedRecipients {
-		if me.Buddies[v] == nil || me.Buddies[v].MpSecretKey == nil {
-			continue
-		}
-		iv := newIV()
-		if IsElem(iv, me.UsedIVs) {
-			iv = newIV()
-		}
+	buf := getBuf()
+	defer putBuf(buf)
+	bhmac := grow(*buf, n*stride)
+	*buf = bhmac
 
-		me.UsedIVs = append(me.UsedIVs, iv)
+	keys := make([]*MPStorage, n)
+	ivs := make([]string, n)
+	for i, v := range sortedRecipients {
+		keys[i] = me.Buddies[v].MpSecretKey
 
-		if encrypted.Text[v] == nil {
-			encrypted.Text[v] = &TextAnswer{}
-		}
-		encrypted.Text[v].Message = encryptAES(message, me.Buddies[v].MpSecretKey.Message, fixIV(iv))
-		encrypted.Text[v].IV = iv
+		iv := bhmac[i*stride+len(padded) : (i+1)*stride]
+		for try := 0; ; try++ {
+			if try == maxIVAttempts {
+				wipe(padded)
+				return nil, ErrStaleIV
+			}
 
-		// Append to HMAC
-		msge, _ := base64.StdEncoding.DecodeString(encrypted.Text[v].Message)
-		bhmac = append(bhmac, msge...)
-		ivee, _ := base64.StdEncoding.DecodeString(encrypted.Text[v].IV)
-		bhmac = append(bhmac, ivee...)
+			if _, err := io.ReadFull(me.rand(), iv); err != nil {
+				wipe(padded)
+				return nil, fmt.Errorf("multiparty: reading IV: %w", err)
+			}
+
+			ivs[i] = base64.StdEncoding.EncodeToString(iv)
+			if me.Replay.Add(me.Name, ivs[i]) {
+				break
+			}
+		}
 	}
 
-	tag := message
-	for _, ve := range sortedRecipients {
-		encrypted.Text[ve].HMAC = HMAC(bhmac, me.Buddies[ve].MpSecretKey.HMAC)
+	texts := make([]TextAnswer, n)
+	macs := make([]byte, n*sha512.Size)
+
+	parallel(n, len(padded), func(i int) {
+		ct := bhmac[i*stride : i*stride+len(padded)]
+		xorCTR(ct, padded, keys[i].Message, bhmac[i*stride+len(padded):(i+1)*stride])
+
+		texts[i].Message = base64.StdEncoding.EncodeToString(ct)
+		texts[i].IV = ivs[i]
+	})
+
+	parallel(n, len(bhmac), func(i int) {
+		mac := hmac.New(sha512.New, keys[i].HMAC)
+		mac.Write(bhmac)
+		sum := mac.Sum(macs[i*sha512.Size : i*sha512.Size : (i+1)*sha512.Size])
 
-		msge, _ := base64.StdEncoding.DecodeString(encrypted.Text[ve].HMAC)
-		tag = append(tag, msge...)
+		texts[i].HMAC = base64.StdEncoding.EncodeToString(sum)
+	})
+
+	encrypted := Answer{
+		Type: "message",
+		Text: make(map[string]*TextAnswer, n),
 	}
 
+	for i, v := range sortedRecipients {
+		encrypted.Text[v] = &texts[i]
+	}
+
+	tag := make([]byte, 0, len(padded)+len(macs))
+	tag = append(tag, padded...)
+	tag = append(tag, macs...)
 	encrypted.Tag = MessageTag(tag)
-	str, _ := json.Marshal(encrypted)
+	wipe(tag[:len(padded)])
+	wipe(padded)
 
-	me._sendFunc(str)
+	str, _ := json.Marshal(encrypted)
+	return str, nil
 }
 
 func (me *Me) RequestPublicKey(s string) {
+	me.lock()
+	msg := me.keyRequestMessage(s)
+	send := me._sendFunc
+	me.unlock()
+
+	transmit(send, msg)
+}
+
+// keyRequestMessage returns a request for the public key of s, or of everyone if s is empty. It returns nil once shut down.
+func (me *Me) keyRequestMessage(s string) []byte {
+	if me.shutdown {
+		return nil
+	}
+
 	d, _ := json.Marshal(map[string]interface{}{
 		"type": "public_key_request",
 		"text": s,
 	})
-	me._sendFunc(d)
+	return d
+}
+
+// Resync asks nick for their public key and announces ours, so that a pair who lost track of each other's keys can talk again.
+// It does nothing if nick was resynced less than ResyncInterval ago, and reports whether anything was sent.
+func (me *Me) Resync(nick string) bool {
+	interval := me.ResyncInterval
+	if interval <= 0 {
+		interval = DefaultResyncInterval
+	}
+
+	me.lock()
+	last := me.keyMap[nick]
+	now := me.now()
+	if last != nil && now.Sub(*last) < interval {
+		me.unlock()
+		return false
+	}
+	me.keyMap[nick] = &now
+
+	request, announce := me.keyRequestMessage(nick), me.publicKeyMessage()
+	send := me._sendFunc
+	me.unlock()
+
+	transmit(send, request, announce)
+	return true
 }
 
 func (me *Me) Out(f func([]byte)) {
+	me.lock()
 	me._sendFunc = f
+	me.unlock()
 }
 
-func (me *Me) receiveMessage(sender string, messageSrc string, mt map[string]interface{}) (string, []byte, error) {
-	if sender == me.Name {
-		return "", nil, nil
-	}
+// FilterKeys installs f to vet public keys from buddies we have not seen yet this session.
+func (me *Me) FilterKeys(f KeyFilter) {
+	me.lock()
+	me.keyFilter = f
+	me.unlock()
+}
+
+// envelope is the outer layer of every multiparty message. Text is decoded once Type is known.
+type envelope struct {
+	Type string          `json:"type"`
+	Text json.RawMessage `json:"text"`
+	Tag  string          `json:"tag"`
+}
 
-	msg := mt["text"]
-	if msg == nil {
-		msg = ""
+// textString decodes a text field that should hold a string. A missing or null field is empty.
+func (e envelope) textString() (string, bool) {
+	var str string
+	if len(e.Text) == 0 {
+		return "", true
 	}
 
-	switch mt["type"] {
+	return str, json.Unmarshal(e.Text, &str) == nil
+}
+
+func (me *Me) receiveMessage(sender string, env envelope, text map[string]*TextAnswer) (Received, error) {
+	switch env.Type {
 	case "public_key":
-		str, ok := msg.(string)
+		str, ok := env.textString()
 		if !ok {
-			return "", nil, fmt.Errorf("public key field is not a string")
+			return Received{}, fmt.Errorf("%w: public key field is not a string", ErrMalformed)
 		}
 
-		if msg == "" {
-			return "", nil, fmt.Errorf("message empty")
+		if str == "" {
+			return Received{}, fmt.Errorf("%w: message empty", ErrMalformed)
 		}
 
 		publicKey, err := base64.StdEncoding.DecodeString(str)
 		if err != nil {
-			return "", nil, err
+			return Received{}, fmt.Errorf("%w: %s", ErrMalformed, err)
+		}
+
+		var pk [32]byte
+		copy(pk[:], publicKey)
+
+		rcv := Received{
+			Kind:      KeyAnnouncement,
+			PublicKey: pk,
 		}
 
 		// Delete their key when they log out. (NYI)
@@ -241,140 +450,214 @@ func (me *Me) receiveMessage(sender string, messageSrc string, mt map[string]int
 			if me.Buddies[sender].CryptoEnabled {
 				pk := me.Buddies[sender].PublicKey[:]
 				if !bytes.Equal(pk, publicKey) {
-					return "", nil, fmt.Errorf("invalid key change")
+					return rcv, ErrKeyChange
 				} else {
-					return "", nil, nil
+					return rcv, nil
 				}
 			}
 		}
 
-		var pk [32]byte
-		copy(pk[:], publicKey)
+		if me.keyFilter != nil && !me.keyFilter(sender, pk) {
+			return rcv, nil
+		}
 
 		if me.Buddies[sender] == nil {
 			me.Buddies[sender] = &Buddy{}
 		}
 
 		me.Buddies[sender].CryptoEnabled = true
-		me.Buddies[sender].PublicKey = pk
+		me.setBuddyKey(sender, pk)
 
 		if me.Buddies[sender].MpSecretKey == nil {
 			me.Buddies[sender].MpSecretKey = me.genSharedSecret(sender)
 		}
 
-		return sender, nil, nil
+		rcv.NewUser = sender
+		return rcv, nil
 	case "public_key_request":
-		str, ok := msg.(string)
+		str, ok := env.textString()
 		if !ok {
-			return "", nil, fmt.Errorf("nickname field is not a string")
+			return Received{}, fmt.Errorf("%w: nickname field is not a string", ErrMalformed)
 		}
 
-		if str == me.Name || str == "" {
-			me.SendPublicKey(sender)
-		}
-		return "", nil, nil
+		// ReceiveMessage answers once the lock is released.
+		return Received{
+			Kind:         KeyRequest,
+			RequestedKey: str,
+		}, nil
 	case "message":
-		var m Answer
-		err := json.Unmarshal([]byte(messageSrc), &m)
-		if err != nil {
-			return "", nil, err
+		self := text[me.Name]
+		if self == nil {
+			// Say who it was for, so the caller can tell being left out from a sender who lost our key.
+			var recipients []string
+			for k := range text {
+				recipients = append(recipients, k)
+			}
+			sort.Strings(recipients)
+			return Received{Recipients: recipients}, ErrNotForMe
 		}
 
-		if m.Text[me.Name] == nil {
-			return "", nil, fmt.Errorf("could not decrypt")
+		buddy := me.Buddies[sender]
+		if buddy == nil {
+			return Received{}, ErrUnknownSender
 		}
 
-		if me.Buddies[sender] == nil {
-			return "", nil, fmt.Errorf("Sender not in buddies")
-		}
-		var missingrecipients []string
-		for r := range me.Buddies {
-			if m.Text[r] == nil {
-				missingrecipients = append(missingrecipients, r)
-				continue
-			} else {
-				if m.Text[r].Message == "" || m.Text[r].HMAC == "" || m.Text[r].IV == "" {
-					missingrecipients = append(missingrecipients, r)
+		// Buddies whose part is absent or incomplete are left out of the HMAC, as the sender would have done.
+		missing := make(map[string]bool)
+		var omitted []string
+		for r, b := range me.Buddies {
+			t := text[r]
+			if t == nil {
+				missing[r] = true
+				if r != sender && b.CryptoEnabled {
+					omitted = append(omitted, r)
 				}
+			} else if t.Message == "" || t.HMAC == "" || t.IV == "" {
+				missing[r] = true
 			}
 		}
+		sort.Strings(omitted)
 
-		var sortedRecipients []string
-
-		for k := range m.Text {
+		var recipients []string
+		sortedRecipients := make([]string, 0, len(text))
+		for k, t := range text {
 			sortedRecipients = append(sortedRecipients, k)
+			if t != nil && t.Message != "" && t.HMAC != "" && t.IV != "" {
+				recipients = append(recipients, k)
+			}
 		}
-
+		sort.Strings(recipients)
 		sort.Strings(sortedRecipients)
 
-		var bhmac []byte
+		buf := getBuf()
+		defer putBuf(buf)
+		bhmac := *buf
+
+		// Where our ciphertext and IV sit in bhmac.
+		var ctStart, ctEnd, ivEnd int
 
 		for _, v := range sortedRecipients {
-			if !IsElem(v, missingrecipients) {
-				mby, err := base64.StdEncoding.DecodeString(m.Text[v].Message)
-				if err != nil {
-					return "", nil, err
-				}
-				bhmac = append(bhmac, mby...)
-				ivby, err := base64.StdEncoding.DecodeString(m.Text[v].IV)
-				if err != nil {
-					return "", nil, err
-				}
-				bhmac = append(bhmac, ivby...)
+			if missing[v] {
+				continue
+			}
+
+			start := len(bhmac)
+			var err error
+			bhmac, err = appendBase64(bhmac, text[v].Message)
+			if err != nil {
+				return Received{}, fmt.Errorf("%w: %s", ErrMalformed, err)
+			}
+			mid := len(bhmac)
+			bhmac, err = appendBase64(bhmac, text[v].IV)
+			if err != nil {
+				return Received{}, fmt.Errorf("%w: %s", ErrMalformed, err)
+			}
+
+			if v == me.Name {
+				ctStart, ctEnd, ivEnd = start, mid, len(bhmac)
 			}
 		}
+		*buf = bhmac
 
-		shmac := me.Buddies[sender].MpSecretKey.HMAC
-		ddmac := HMAC(bhmac, shmac)
-		if m.Text[me.Name].HMAC != ddmac {
-			return "", nil, fmt.Errorf("hmac failure")
+		theirs, err := base64.StdEncoding.DecodeString(self.HMAC)
+		mac := hmac.New(sha512.New, buddy.MpSecretKey.HMAC)
+		mac.Write(bhmac)
+		if err != nil || !hmac.Equal(theirs, mac.Sum(nil)) {
+			return Received{}, ErrHMAC
 		}
 
-		if IsElem(m.Text[me.Name].IV, me.UsedIVs) {
-			return "", nil, fmt.Errorf("IV reuse detected, possible replay attack")
+		if !me.Replay.Add(sender, self.IV) {
+			return Received{}, ErrReplay
 		}
 
-		me.UsedIVs = append(me.UsedIVs, m.Text[me.Name].IV)
+		// An IV too short to hold a nonce means a zero counter block, as in Cryptodog.
+		iv := bhmac[ctEnd:ivEnd]
+		if len(iv) < 12 {
+			iv = nil
+		}
+
+		// The tag covers the padded plaintext followed by every HMAC, so decrypt straight into the front of it.
+		n := ctEnd - ctStart
+		mtag := make([]byte, n, n+len(sortedRecipients)*sha512.Size)
+		xorCTR(mtag, bhmac[ctStart:ctEnd], buddy.MpSecretKey.Message, iv)
 
-		iv := fixIV(m.Text[me.Name].IV)
-		plaintext := decryptAES(m.Text[me.Name].Message, me.Buddies[sender].MpSecretKey.Message, iv)
-		mtag := plaintext
 		for _, v := range sortedRecipients {
-			h, err := base64.StdEncoding.DecodeString(m.Text[v].HMAC)
-			if err != nil {
-				continue
-			}
-			mtag = append(mtag, h...)
+			mtag, _ = appendBase64(mtag, text[v].HMAC)
 		}
 
-		mmtag := MessageTag(mtag)
-		if mmtag != m.Tag {
-			return "", nil, fmt.Errorf("Message tag failure")
+		if MessageTag(mtag) != env.Tag {
+			wipe(mtag[:n])
+			return Received{}, ErrTag
 		}
 
-		if len(plaintext) < 64 {
-			return "", nil, fmt.Errorf("Invalid plaintext size")
+		if n < 64 {
+			return Received{}, fmt.Errorf("%w: invalid plaintext size", ErrMalformed)
 		}
 
-		return "", plaintext[:len(plaintext)-64], nil
+		plaintext := unpad(mtag[:n])
+		return Received{
+			Kind:       Payload,
+			Plaintext:  plaintext[:len(plaintext):len(plaintext)],
+			Omitted:    omitted,
+			Recipients: recipients,
+		}, nil
 	}
 
-	return "", nil, nil
+	return Received{Kind: Ignored}, nil
 }
 
 func (me *Me) genFingerprint(nick string) string {
 	me.lock()
-
 	defer me.unlock()
-	key := me.PublicKey[:]
-	if nick != "" {
-		if me.Buddies[nick] == nil {
-			return ""
-		}
-		key = me.Buddies[nick].PublicKey[:]
+
+	if nick == "" {
+		return me.fingerprint
+	}
+
+	if me.Buddies[nick] == nil {
+		return ""
 	}
 
-	fp := Sha512(key)
+	return me.Buddies[nick].Fingerprint
+}
+
+func (me *Me) derivePublicKey() {
+	curve25519.ScalarBaseMult(&me.PublicKey, &me.SecretKey)
+	me.fingerprint = FingerprintKey(me.PublicKey[:])
+}
+
+// setBuddyKey records a buddy's public key and keeps the fingerprint index up to date. The buddy must exist.
+func (me *Me) setBuddyKey(nick string, publicKey [32]byte) {
+	b := me.Buddies[nick]
+	me.unindexBuddy(nick)
+
+	b.PublicKey = publicKey
+	b.Fingerprint = FingerprintKey(publicKey[:])
+
+	names := me.byFingerprint[b.Fingerprint]
+	if names == nil {
+		names = make(map[string]struct{})
+		me.byFingerprint[b.Fingerprint] = names
+	}
+	names[nick] = struct{}{}
+}
+
+func (me *Me) unindexBuddy(nick string) {
+	b := me.Buddies[nick]
+	if b == nil || b.Fingerprint == "" {
+		return
+	}
+
+	names := me.byFingerprint[b.Fingerprint]
+	delete(names, nick)
+	if len(names) == 0 {
+		delete(me.byFingerprint, b.Fingerprint)
+	}
+}
+
+// FingerprintKey returns the fingerprint of a public key as shown by Cryptodog: the first 40 hex digits of its SHA-512 hash.
+func FingerprintKey(publicKey []byte) string {
+	fp := Sha512(publicKey)
 	fps := hex.EncodeToString(fp)
 	fps = strings.ToUpper(fps)
 	return fps[:40]
@@ -398,70 +681,67 @@ func fpspace(key string) string {
 	return string(formatted)
 }
 
-func (me *Me) genSharedSecret(nick string) *MPStorage {
-	var secret [32]byte
-
-	curve25519.ScalarMult(&secret, &me.SecretKey, &me.Buddies[nick].PublicKey)
-	shash := Sha512(secret[:])
-
-	return &MPStorage{
-		Message: shash[0:32],
-		HMAC:    shash[32:64],
-	}
+// DerivePublicKey returns the public key belonging to a secret key.
+func DerivePublicKey(secretKey [32]byte) [32]byte {
+	var pk [32]byte
+	curve25519.ScalarBaseMult(&pk, &secretKey)
+	return pk
 }
 
-func fixIV(s string) []byte {
-	buf, _ := base64.StdEncoding.DecodeString(s)
-	if len(buf) < 12 {
-		return make([]byte, 16)
-	}
+// SetSecretKey replaces our key pair, recomputing the secrets shared with every buddy.
+// Buddies will not be able to read our messages until they learn the new public key.
+func (me *Me) SetSecretKey(secretKey [32]byte) {
+	me.lock()
+	defer me.unlock()
 
-	buf = append(buf[:12], []byte{0x00, 0x00, 0x00, 0x00}...)
-	return buf
-}
+	me.SecretKey = secretKey
+	me.derivePublicKey()
 
-func newIV() string {
-	buf := make([]byte, 12)
-	rand.Read(buf)
-	return base64.StdEncoding.EncodeToString(buf)
+	for k, v := range me.Buddies {
+		if v.CryptoEnabled {
+			v.MpSecretKey.wipe()
+			v.MpSecretKey = me.genSharedSecret(k)
+		}
+	}
 }
 
-func DeriveKey(password string) []byte {
-	bytes := sha256.Sum256([]byte(password))
-	return bytes[:32]
-}
+// RotateBuddyKey replaces the public key of a buddy whose current key is already established, provided it is still old.
+// The caller is responsible for checking that the new key was vouched for by old. If the buddy's key changed in the meantime, ErrKeyChange is returned.
+func (me *Me) RotateBuddyKey(nick string, old, publicKey [32]byte) error {
+	me.lock()
+	defer me.unlock()
 
-func encryptAES(plaintext, key []byte, iv []byte) string {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		panic(err)
+	b := me.Buddies[nick]
+	if b == nil || !b.CryptoEnabled {
+		return ErrUnknownSender
 	}
 
-	ciphertext := make([]byte, len(plaintext))
-
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext, plaintext)
+	if b.PublicKey != old {
+		return ErrKeyChange
+	}
 
-	return base64.StdEncoding.EncodeToString(ciphertext)
+	me.setBuddyKey(nick, publicKey)
+	b.MpSecretKey.wipe()
+	b.MpSecretKey = me.genSharedSecret(nick)
+	return nil
 }
 
-func decryptAES(msg string, key []byte, iv []byte) []byte {
-	ciphertext, err := base64.StdEncoding.DecodeString(msg)
-	if err != nil {
-		return []byte("malformed message")
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		panic(err)
-	}
+func (me *Me) genSharedSecret(nick string) *MPStorage {
+	var secret [32]byte
 
-	plaintext := make([]byte, len(ciphertext))
+	curve25519.ScalarMult(&secret, &me.SecretKey, &me.Buddies[nick].PublicKey)
+	shash := Sha512(secret[:])
+	wipe(secret[:])
 
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(plaintext, ciphertext)
+	return &MPStorage{
+		Message: shash[0:32],
+		HMAC:    shash[32:64],
+	}
+}
 
-	return plaintext
+func DeriveKey(password string) []byte {
+	bytes := sha256.Sum256([]byte(password))
+	return bytes[:32]
 }
 
 func NewMe(username string, profile string) (*Me, error) {
@@ -470,6 +750,8 @@ func NewMe(username string, profile string) (*Me, error) {
 	me.Buddies = make(map[string]*Buddy)
 	me.keyMap = make(map[string]*time.Time)
 	me.blacklist = make(map[string]bool)
+	me.byFingerprint = make(map[string]map[string]struct{})
+	me.Replay = NewReplayCache()
 
 	if profile != "" {
 		b, err := base64.StdEncoding.DecodeString(profile)
@@ -478,7 +760,8 @@ func NewMe(username string, profile string) (*Me, error) {
 		}
 
 		copy(me.SecretKey[:], b)
-		curve25519.ScalarBaseMult(&me.PublicKey, &me.SecretKey)
+		wipe(b)
+		me.derivePublicKey()
 	} else {
 		me.GenerateKeys()
 	}
@@ -487,37 +770,150 @@ func NewMe(username string, profile string) (*Me, error) {
 	return me, nil
 }
 
-func (me *Me) ReceiveMessage(sender, message string) (string, []byte, error) {
-	if me.MaximumMessageSize == 0 {
-		me.MaximumMessageSize = 6000
+var (
+	ErrMalformed     = errors.New("multiparty: malformed message")
+	ErrNotForMe      = errors.New("multiparty: message was not encrypted for us")
+	ErrUnknownSender = errors.New("multiparty: sender has not announced a public key")
+	ErrHMAC          = errors.New("multiparty: hmac failure")
+	ErrTag           = errors.New("multiparty: message tag failure")
+	ErrReplay        = errors.New("multiparty: IV reuse detected, possible replay attack")
+	ErrKeyChange     = errors.New("multiparty: invalid key change")
+	ErrShutdown      = errors.New("multiparty: session has been shut down")
+	ErrTooLarge      = errors.New("multiparty: message exceeded maximum size, refusing to decrypt")
+	// Returned by SendMessage and SendMessageTo when peers would refuse the message with ErrTooLarge.
+	ErrMessageTooLarge = errors.New("multiparty: message too large to send")
+	// Returned when Rand keeps giving IVs we have already used, which only a broken or exhausted reader does.
+	ErrStaleIV = errors.New("multiparty: could not draw an unused IV")
+	// Returned by SendMessageTo when none of the recipients have exchanged keys with us.
+	ErrNoRecipients = errors.New("multiparty: none of the recipients have exchanged keys with us")
+)
+
+type ReceivedKind int
+
+const (
+	// Nothing for the caller to act on, such as our own messages or unknown types.
+	Ignored ReceivedKind = iota
+	// The sender announced their public key.
+	KeyAnnouncement
+	// The sender asked for public keys. We have already answered if it was for ours.
+	KeyRequest
+	// An encrypted message was decrypted.
+	Payload
+)
+
+// Received describes the outcome of a message passed to ReceiveMessage.
+type Received struct {
+	Kind ReceivedKind
+
+	// Set on KeyAnnouncement, even if the key was refused.
+	PublicKey [32]byte
+	// Set on KeyAnnouncement when the sender's public key has just been accepted.
+	NewUser string
+
+	// Set on KeyRequest: whose key was requested, or empty for everyone's.
+	RequestedKey string
+
+	// The decrypted message, with padding removed.
+	Plaintext []byte
+	// Buddies with established keys that the sender did not encrypt the message for, sorted.
+	// A sender showing different content to different members of the room will leave some of them out.
+	Omitted []string
+	// Everyone the message was encrypted for, ourselves included, sorted.
+	// Also set with ErrNotForMe, when it lists everyone but us.
+	Recipients []string
+}
+
+func (me *Me) ReceiveMessage(sender, message string) (Received, error) {
+	if sender == me.Name {
+		return Received{Kind: Ignored}, nil
 	}
 
-	var mt map[string]interface{}
-	err := json.Unmarshal([]byte(message), &mt)
-	if err != nil {
-		return "", nil, err
+	max := me.maxMessageSize()
+
+	// Parsing needs no lock, so it is done before taking one.
+	var env envelope
+	if err := json.Unmarshal([]byte(message), &env); err != nil {
+		return Received{}, fmt.Errorf("%w: %s", ErrMalformed, err)
 	}
 
-	if mt["type"] == "message" {
-		var ans Answer
-		json.Unmarshal([]byte(message), &ans)
-		if cont := ans.Text[me.Name]; cont != nil {
-			if len(cont.Message) > me.MaximumMessageSize {
-				return "", nil, fmt.Errorf("message exceeded maximum size, refusing to decrypt")
+	var text map[string]*TextAnswer
+	if env.Type == "message" && len(env.Text) > 0 {
+		if err := json.Unmarshal(env.Text, &text); err != nil {
+			return Received{}, fmt.Errorf("%w: %s", ErrMalformed, err)
+		}
+
+		// A null entry carries nothing, so treat it like an absent one.
+		for k, v := range text {
+			if v == nil {
+				delete(text, k)
 			}
 		}
+
+		if cont := text[me.Name]; cont != nil && len(cont.Message) > max {
+			return Received{}, ErrTooLarge
+		}
 	}
 
 	me.lock()
-	keyAuth, b, err := me.receiveMessage(sender, message, mt)
+	if me.shutdown {
+		me.unlock()
+		return Received{}, ErrShutdown
+	}
+
+	rcv, err := me.receiveMessage(sender, env, text)
+
+	var reply []byte
+	if rcv.Kind == KeyRequest && (rcv.RequestedKey == me.Name || rcv.RequestedKey == "") {
+		reply = me.publicKeyMessage()
+	}
+	send := me._sendFunc
 	me.unlock()
-	return keyAuth, b, err
+
+	transmit(send, reply)
+	return rcv, err
 }
 
-func (me *Me) SendMessage(message []byte) {
+// SendMessage encrypts a message for every buddy with a key. It fails with ErrMessageTooLarge if the ciphertext would be larger than MaximumMessageSize.
+func (me *Me) SendMessage(message []byte) error {
 	me.lock()
-	me.sendMessage(message)
+	msg, err := me.encryptMessage(message, nil)
+	send := me._sendFunc
 	me.unlock()
+
+	if err != nil {
+		return err
+	}
+
+	transmit(send, msg)
+	return nil
+}
+
+// SendMessageTo sends a group message that only the named buddies can decrypt.
+// Everyone else in the room still sees the message, along with who it was for.
+func (me *Me) SendMessageTo(recipients []string, message []byte) error {
+	me.lock()
+	var ready []string
+	for _, v := range recipients {
+		if b := me.Buddies[v]; b != nil && b.CryptoEnabled && b.MpSecretKey != nil {
+			ready = append(ready, v)
+		}
+	}
+
+	if len(ready) == 0 {
+		me.unlock()
+		return ErrNoRecipients
+	}
+
+	msg, err := me.encryptMessage(message, ready)
+	send := me._sendFunc
+	me.unlock()
+
+	if err != nil {
+		return err
+	}
+
+	transmit(send, msg)
+	return nil
 }
 
 func (me *Me) ClearBlacklist() {
@@ -526,37 +922,77 @@ func (me *Me) ClearBlacklist() {
 	me.keyLock.Unlock()
 }
 
+// NamesByFingerprint returns every buddy whose key has the fingerprint fp, sorted.
 func (me *Me) NamesByFingerprint(fp string) []string {
-	var allNames []string
 	var matchedNames []string
 	me.lock()
-	for k := range me.Buddies {
-		allNames = append(allNames, k)
+	for k := range me.byFingerprint[fp] {
+		matchedNames = append(matchedNames, k)
 	}
 	me.unlock()
 
-	for _, k := range allNames {
-		if fp == me.genFingerprint(k) {
-			matchedNames = append(matchedNames, k)
-		}
-	}
-
 	sort.Strings(matchedNames)
 	return matchedNames
 }
 
 func (me *Me) SortedNames() []string {
 	var names []string
+	me.lock()
 	for k := range me.Buddies {
 		names = append(names, k)
 	}
+	me.unlock()
 	sort.Strings(names)
 	return names
 }
 
+// GetBuddy returns a copy of a buddy's state, which stays valid however the Me changes afterwards.
+func (me *Me) GetBuddy(nick string) (Buddy, bool) {
+	me.lock()
+	defer me.unlock()
+
+	b := me.Buddies[nick]
+	if b == nil {
+		return Buddy{}, false
+	}
+
+	cp := *b
+	if b.MpSecretKey != nil {
+		cp.MpSecretKey = &MPStorage{
+			Message: append([]byte(nil), b.MpSecretKey.Message...),
+			HMAC:    append([]byte(nil), b.MpSecretKey.HMAC...),
+		}
+	}
+	return cp, true
+}
+
+// BuddyKey returns the public key we accepted for a buddy, and whether there is one.
+func (me *Me) BuddyKey(nick string) ([32]byte, bool) {
+	me.lock()
+	defer me.unlock()
+
+	b := me.Buddies[nick]
+	if b == nil || !b.CryptoEnabled {
+		return [32]byte{}, false
+	}
+	return b.PublicKey, true
+}
+
+// GetPublicKey returns our current public key.
+func (me *Me) GetPublicKey() [32]byte {
+	me.lock()
+	defer me.unlock()
+	return me.PublicKey
+}
+
+// DestroyUser forgets a buddy, wiping the secrets we shared with them.
 func (me *Me) DestroyUser(name string) {
 	me.lock()
 
+	if b := me.Buddies[name]; b != nil {
+		b.MpSecretKey.wipe()
+	}
+	me.unindexBuddy(name)
 	delete(me.Buddies, name)
 	delete(me.keyMap, name)
 	me.unlock()
@@ -573,6 +1009,15 @@ func (me *Me) SaveProfile() string {
 	return b
 }
 
+// HasSharedKey reports whether we have derived a shared secret with nick from a key they announced.
+func (me *Me) HasSharedKey(nick string) bool {
+	me.lock()
+	defer me.unlock()
+
+	b := me.Buddies[nick]
+	return b != nil && b.MpSecretKey != nil
+}
+
 func (me *Me) Fingerprint(username string) string {
 	fp := me.genFingerprint(username)
 	return fp
@@ -591,7 +1036,36 @@ func (me *Me) FingerprintUser(username string) (string, error) {
 	return fpspace(fp), nil
 }
 
+// Shutdown wipes our secret key and every shared secret, and forgets all buddies.
+// Afterwards nothing is sent, and ReceiveMessage returns ErrShutdown.
 func (me *Me) Shutdown() {
+	me.lock()
+	defer me.unlock()
+
+	for k, v := range me.Buddies {
+		v.MpSecretKey.wipe()
+		delete(me.Buddies, k)
+	}
+	me.byFingerprint = make(map[string]map[string]struct{})
+
+	wipe(me.SecretKey[:])
+	me.shutdown = true
+}
+
+// wipe overwrites b with zeros. It is best effort: the Go runtime may have left copies of b elsewhere, such as after growing a slice.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func (s *MPStorage) wipe() {
+	if s == nil {
+		return
+	}
+
+	wipe(s.Message)
+	wipe(s.HMAC)
 }
 
 func (me *Me) IsSessionInitialized(nickname string) bool {
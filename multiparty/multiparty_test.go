@@ -0,0 +1,745 @@
+package multiparty
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type packet struct {
+	from string
+	data []byte
+}
+
+// testNet connects several Me's as if they were in the same room. Messages are queued and only delivered by flush.
+type testNet struct {
+	t       testing.TB
+	members map[string]*Me
+	queue   []packet
+
+	plaintexts map[string][][]byte
+	errors     map[string][]error
+}
+
+func newTestNet(t testing.TB, names ...string) *testNet {
+	n := &testNet{
+		t:          t,
+		members:    make(map[string]*Me),
+		plaintexts: make(map[string][][]byte),
+		errors:     make(map[string][]error),
+	}
+
+	for _, v := range names {
+		n.join(v)
+	}
+
+	n.flush()
+	return n
+}
+
+func (n *testNet) join(name string) *Me {
+	return n.joinSecret(name, "")
+}
+
+// joinSecret adds a member with the given secret key, or a random one if it is empty. Call flush to exchange keys.
+func (n *testNet) joinSecret(name, secret string) *Me {
+	me, err := NewMe(name, secret)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+
+	me.Out(func(b []byte) {
+		n.queue = append(n.queue, packet{name, b})
+	})
+
+	n.members[name] = me
+	me.SendPublicKey("")
+	return me
+}
+
+func (n *testNet) names() []string {
+	var names []string
+	for k := range n.members {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flush delivers queued messages, including any replies they provoke, until nothing is left.
+func (n *testNet) flush() {
+	for len(n.queue) > 0 {
+		p := n.queue[0]
+		n.queue = n.queue[1:]
+
+		for _, name := range n.names() {
+			if name == p.from {
+				continue
+			}
+
+			rcv, err := n.members[name].ReceiveMessage(p.from, string(p.data))
+			if err != nil {
+				n.errors[name] = append(n.errors[name], err)
+			}
+
+			if rcv.Plaintext != nil {
+				n.plaintexts[name] = append(n.plaintexts[name], rcv.Plaintext)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	n := newTestNet(t, "alice", "bob", "carol")
+
+	n.members["alice"].SendMessage([]byte("hello"))
+	n.flush()
+
+	for _, v := range []string{"bob", "carol"} {
+		if len(n.errors[v]) > 0 {
+			t.Fatal(v, n.errors[v])
+		}
+
+		if len(n.plaintexts[v]) != 1 || string(n.plaintexts[v][0]) != "hello" {
+			t.Fatal(v, "received", n.plaintexts[v])
+		}
+	}
+}
+
+func TestOmittedRecipients(t *testing.T) {
+	n := newTestNet(t, "alice", "bob", "carol")
+
+	// Alice stops encrypting for carol, as a split-view attacker would.
+	n.members["alice"].BlacklistUser("carol")
+
+	var sent []byte
+	n.members["alice"].Out(func(b []byte) {
+		sent = b
+	})
+	n.members["alice"].SendMessage([]byte("just for bob"))
+
+	rcv, err := n.members["bob"].ReceiveMessage("alice", string(sent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rcv.Plaintext) != "just for bob" {
+		t.Fatal("got", string(rcv.Plaintext))
+	}
+
+	if len(rcv.Omitted) != 1 || rcv.Omitted[0] != "carol" {
+		t.Fatal("expected carol to be reported as omitted, got", rcv.Omitted)
+	}
+}
+
+func TestSendMessageTo(t *testing.T) {
+	n := newTestNet(t, "alice", "bob", "carol", "dave")
+
+	if err := n.members["alice"].SendMessageTo([]string{"bob", "dave", "nobody"}, []byte("mods only")); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []byte
+	n.members["alice"].Out(func(b []byte) {
+		sent = b
+	})
+	n.members["alice"].SendMessageTo([]string{"bob", "dave"}, []byte("mods only"))
+
+	for _, v := range []string{"bob", "dave"} {
+		rcv, err := n.members[v].ReceiveMessage("alice", string(sent))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(rcv.Plaintext) != "mods only" {
+			t.Fatal(v, "got", string(rcv.Plaintext))
+		}
+
+		if len(rcv.Recipients) != 2 || rcv.Recipients[0] != "bob" || rcv.Recipients[1] != "dave" {
+			t.Fatal(v, "saw recipients", rcv.Recipients)
+		}
+	}
+
+	if _, err := n.members["carol"].ReceiveMessage("alice", string(sent)); !errors.Is(err, ErrNotForMe) {
+		t.Fatal("carol should not be able to read the message, got", err)
+	}
+
+	if err := n.members["alice"].SendMessageTo([]string{"nobody"}, []byte("x")); !errors.Is(err, ErrNoRecipients) {
+		t.Fatal("expected ErrNoRecipients, got", err)
+	}
+}
+
+func TestReceiveErrors(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+
+	var sent []byte
+	n.members["alice"].Out(func(b []byte) {
+		sent = b
+	})
+	n.members["alice"].SendMessage([]byte("once"))
+
+	bob := n.members["bob"]
+	rcv, err := bob.ReceiveMessage("alice", string(sent))
+	if err != nil || rcv.Kind != Payload {
+		t.Fatal("expected a payload, got", rcv.Kind, err)
+	}
+
+	if _, err := bob.ReceiveMessage("alice", string(sent)); !errors.Is(err, ErrReplay) {
+		t.Fatal("expected ErrReplay, got", err)
+	}
+
+	n.members["alice"].SendMessage([]byte("tampered"))
+	var ans Answer
+	if err := json.Unmarshal(sent, &ans); err != nil {
+		t.Fatal(err)
+	}
+	ans.Text["bob"].HMAC = "AAAA"
+	tampered, _ := json.Marshal(ans)
+	if _, err := bob.ReceiveMessage("alice", string(tampered)); !errors.Is(err, ErrHMAC) {
+		t.Fatal("expected ErrHMAC, got", err)
+	}
+
+	if _, err := bob.ReceiveMessage("alice", "{"); !errors.Is(err, ErrMalformed) {
+		t.Fatal("expected ErrMalformed, got", err)
+	}
+
+	if _, err := bob.ReceiveMessage("mallory", string(sent)); !errors.Is(err, ErrUnknownSender) {
+		t.Fatal("expected ErrUnknownSender, got", err)
+	}
+
+	// Someone else takes alice's nickname with a new key.
+	impostor, err := NewMe("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor.Out(func(b []byte) {
+		sent = b
+	})
+	impostor.SendPublicKey("")
+
+	rcv, err = bob.ReceiveMessage("alice", string(sent))
+	if !errors.Is(err, ErrKeyChange) {
+		t.Fatal("expected ErrKeyChange, got", err)
+	}
+	if rcv.Kind != KeyAnnouncement || rcv.PublicKey != impostor.PublicKey {
+		t.Fatal("key change should report the announced key")
+	}
+
+	impostor.RequestPublicKey("bob")
+	rcv, err = bob.ReceiveMessage("alice", string(sent))
+	if err != nil || rcv.Kind != KeyRequest || rcv.RequestedKey != "bob" {
+		t.Fatal("expected a key request for bob, got", rcv.Kind, rcv.RequestedKey, err)
+	}
+}
+
+func TestResync(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+
+	// Bob forgets alice's key, as if the announcement had been missed.
+	n.members["bob"].DestroyUser("alice")
+
+	n.members["alice"].SendMessage([]byte("lost"))
+	n.flush()
+
+	if len(n.errors["bob"]) != 1 || !errors.Is(n.errors["bob"][0], ErrUnknownSender) {
+		t.Fatal("expected ErrUnknownSender, got", n.errors["bob"])
+	}
+
+	if !n.members["bob"].Resync("alice") {
+		t.Fatal("first resync should not be throttled")
+	}
+	if n.members["bob"].Resync("alice") {
+		t.Fatal("second resync should be throttled")
+	}
+	n.flush()
+
+	n.members["alice"].SendMessage([]byte("found"))
+	n.flush()
+
+	if len(n.errors["bob"]) != 1 {
+		t.Fatal("unexpected errors after resync", n.errors["bob"])
+	}
+	if len(n.plaintexts["bob"]) != 1 || string(n.plaintexts["bob"][0]) != "found" {
+		t.Fatal("bob received", n.plaintexts["bob"])
+	}
+}
+
+// TestConcurrentUse hammers every entry point of several Me's at once. Run it with -race.
+func TestConcurrentUse(t *testing.T) {
+	names := []string{"alice", "bob", "carol"}
+	members := make(map[string]*Me)
+	inbox := make(map[string]chan packet)
+	done := make(chan struct{})
+
+	for _, v := range names {
+		me, err := NewMe(v, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[v] = me
+		inbox[v] = make(chan packet, 256)
+	}
+
+	for _, v := range names {
+		from := v
+		members[v].Out(func(b []byte) {
+			for _, to := range names {
+				if to == from {
+					continue
+				}
+
+				// Receivers answer key requests from their own goroutines, so drop rather than wait on a busy receiver.
+				select {
+				case inbox[to] <- packet{from, b}:
+				default:
+				}
+			}
+		})
+	}
+
+	var receivers sync.WaitGroup
+	for _, v := range names {
+		receivers.Add(1)
+		go func(name string) {
+			defer receivers.Done()
+			for {
+				select {
+				case p := <-inbox[name]:
+					members[name].ReceiveMessage(p.from, string(p.data))
+				case <-done:
+					return
+				}
+			}
+		}(v)
+	}
+
+	var wg sync.WaitGroup
+	for _, v := range names {
+		me := members[v]
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				me.SendMessage([]byte("hammer"))
+				me.SendMessageTo([]string{"alice", "bob"}, []byte("hammer"))
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				other := names[i%len(names)]
+				me.DestroyUser(other)
+				me.SendPublicKey("")
+				me.RequestPublicKey(other)
+				me.Resync(other)
+				me.BlacklistUser(other)
+				me.UnblacklistUser(other)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				other := names[i%len(names)]
+				me.SortedNames()
+				me.GetBuddy(other)
+				me.GetPublicKey()
+				me.Fingerprint(other)
+				me.NamesByFingerprint(me.Fingerprint(other))
+				me.IsSessionInitialized(other)
+				if i%50 == 0 {
+					me.GenerateKeys()
+					me.ClearBlacklist()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	receivers.Wait()
+}
+
+func TestBlockedOut(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+	alice, bob := n.members["alice"], n.members["bob"]
+
+	var msg []byte
+	bob.Out(func(b []byte) {
+		msg = b
+	})
+	if err := bob.SendMessage([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's network is stuck, so her send waits in Out.
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	alice.Out(func([]byte) {
+		once.Do(func() {
+			close(blocked)
+		})
+		<-release
+	})
+	defer close(release)
+
+	go alice.SendMessage([]byte("stuck"))
+	<-blocked
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := alice.ReceiveMessage("bob", string(msg))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiving waited for a blocked send")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	n := newTestNet(t, "alice", "bob", "carol")
+	alice := n.members["alice"]
+
+	bob := alice.Buddies["bob"].MpSecretKey
+	alice.DestroyUser("bob")
+	if !bytes.Equal(bob.Message, make([]byte, 32)) || !bytes.Equal(bob.HMAC, make([]byte, 32)) {
+		t.Fatal("DestroyUser left shared secrets in memory")
+	}
+
+	carol := alice.Buddies["carol"].MpSecretKey
+	alice.Shutdown()
+	if alice.SecretKey != [32]byte{} || !bytes.Equal(carol.Message, make([]byte, 32)) {
+		t.Fatal("Shutdown left key material in memory")
+	}
+
+	if len(alice.SortedNames()) != 0 {
+		t.Fatal("Shutdown should forget buddies")
+	}
+
+	sent := false
+	alice.Out(func([]byte) {
+		sent = true
+	})
+	alice.SendMessage([]byte("after shutdown"))
+	alice.SendPublicKey("")
+	if sent {
+		t.Fatal("a shut down Me should not send anything")
+	}
+
+	n.members["bob"].SendPublicKey("")
+	if _, err := alice.ReceiveMessage("bob", string(n.queue[len(n.queue)-1].data)); !errors.Is(err, ErrShutdown) {
+		t.Fatal("expected ErrShutdown, got", err)
+	}
+}
+
+// newStar returns a sender that has exchanged keys with n recipients, and the first recipient.
+// Only the first recipient learns the sender's key, which is all the benchmarks need.
+func newStar(tb testing.TB, n int) (*Me, *Me) {
+	alice, err := NewMe("alice", "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var first *Me
+	for i := 0; i < n; i++ {
+		r, err := NewMe(fmt.Sprintf("member%03d", i), "")
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		r.Out(func(b []byte) {
+			if _, err := alice.ReceiveMessage(r.Name, string(b)); err != nil {
+				tb.Fatal(err)
+			}
+		})
+		r.SendPublicKey("")
+
+		if first == nil {
+			first = r
+			alice.Out(func(b []byte) {
+				if _, err := first.ReceiveMessage("alice", string(b)); err != nil {
+					tb.Fatal(err)
+				}
+			})
+			alice.SendPublicKey("")
+		}
+	}
+
+	alice.Out(func([]byte) {})
+	return alice, first
+}
+
+var benchRecipients = []int{10, 100, 500}
+
+// BenchmarkSend compares sending with the per-recipient work split over goroutines and done in turn.
+// Run it with -cpu 1,4; parallel never uses more goroutines than there are CPUs.
+func BenchmarkSend(b *testing.B) {
+	defer func(w int) {
+		parallelMinWork = w
+	}(parallelMinWork)
+
+	for _, n := range benchRecipients {
+		for _, mode := range []struct {
+			name    string
+			minWork int
+		}{{"sequential", math.MaxInt32}, {"parallel", 0}} {
+			b.Run(fmt.Sprintf("recipients=%d/%s", n, mode.name), func(b *testing.B) {
+				parallelMinWork = mode.minWork
+				alice, _ := newStar(b, n)
+				msg := bytes.Repeat([]byte("x"), 256)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					alice.SendMessage(msg)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkReceive(b *testing.B) {
+	for _, n := range benchRecipients {
+		b.Run(fmt.Sprintf("recipients=%d", n), func(b *testing.B) {
+			alice, first := newStar(b, n)
+			msg := bytes.Repeat([]byte("x"), 256)
+
+			var sent []byte
+			alice.Out(func(d []byte) {
+				sent = d
+			})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				alice.SendMessage(msg)
+				b.StartTimer()
+
+				if _, err := first.ReceiveMessage("alice", string(sent)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Rooms above parallelThreshold take the parallel path. Run with -cpu 4 to exercise it.
+func TestLargeRoom(t *testing.T) {
+	alice, first := newStar(t, 4*parallelThreshold)
+
+	var sent []byte
+	alice.Out(func(d []byte) {
+		sent = d
+	})
+
+	alice.SendMessage([]byte("everyone"))
+
+	rcv, err := first.ReceiveMessage("alice", string(sent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rcv.Plaintext) != "everyone" || len(rcv.Recipients) != 4*parallelThreshold {
+		t.Fatal("got", string(rcv.Plaintext), "for", len(rcv.Recipients), "recipients")
+	}
+}
+
+func TestFingerprintIndex(t *testing.T) {
+	n := newTestNet(t, "alice", "bob", "carol")
+	alice, bob := n.members["alice"], n.members["bob"]
+
+	fp := bob.Fingerprint("")
+	if fp != FingerprintKey(bob.PublicKey[:]) || alice.Fingerprint("bob") != fp {
+		t.Fatal("cached fingerprint differs from the key's")
+	}
+
+	if names := alice.NamesByFingerprint(fp); len(names) != 1 || names[0] != "bob" {
+		t.Fatal("lookup returned", names)
+	}
+
+	next, _ := NewMe("bob", "")
+	if err := alice.RotateBuddyKey("bob", next.PublicKey, next.PublicKey); err != ErrKeyChange {
+		t.Fatal("rotation from a key bob no longer has returned", err)
+	}
+
+	alice.RotateBuddyKey("bob", bob.PublicKey, next.PublicKey)
+	if len(alice.NamesByFingerprint(fp)) != 0 || len(alice.NamesByFingerprint(next.Fingerprint(""))) != 1 {
+		t.Fatal("index not updated on rotation")
+	}
+
+	alice.DestroyUser("bob")
+	if len(alice.NamesByFingerprint(next.Fingerprint(""))) != 0 {
+		t.Fatal("index not updated on DestroyUser")
+	}
+
+	before := alice.Fingerprint("")
+	alice.GenerateKeys()
+	pk := alice.GetPublicKey()
+	if alice.Fingerprint("") == before || alice.Fingerprint("") != FingerprintKey(pk[:]) {
+		t.Fatal("own fingerprint not updated")
+	}
+}
+
+func BenchmarkNamesByFingerprint(b *testing.B) {
+	alice, first := newStar(b, 500)
+	fp := first.Fingerprint("")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		alice.NamesByFingerprint(fp)
+	}
+}
+
+// countingReader is a reproducible stand-in for crypto/rand: the SHA-256 of a counter, block after block,
+// so that it does not repeat however long a test runs.
+type countingReader struct {
+	n   uint64
+	buf []byte
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	for i := range b {
+		if len(c.buf) == 0 {
+			var ctr [8]byte
+			binary.BigEndian.PutUint64(ctr[:], c.n)
+			c.n++
+			sum := sha256.Sum256(ctr[:])
+			c.buf = sum[:]
+		}
+		b[i] = c.buf[0]
+		c.buf = c.buf[1:]
+	}
+	return len(b), nil
+}
+
+func TestDeterministicSend(t *testing.T) {
+	send := func() []byte {
+		alice, _ := NewMe("alice", "")
+		bob, _ := NewMe("bob", "")
+		alice.Rand = &countingReader{n: 0}
+		bob.Rand = &countingReader{n: 100}
+		alice.GenerateKeys()
+		bob.GenerateKeys()
+
+		var out []byte
+		alice.Out(func(b []byte) {
+			out = b
+		})
+		bob.Out(func(b []byte) {
+			alice.ReceiveMessage("bob", string(b))
+		})
+		bob.SendPublicKey("")
+
+		alice.SendMessage([]byte("hello"))
+		return out
+	}
+
+	a, b := send(), send()
+	if a == nil || !bytes.Equal(a, b) {
+		t.Fatalf("ciphertexts differ:\n%s\n%s", a, b)
+	}
+}
+
+func TestParallelSend(t *testing.T) {
+	alice, _ := newStar(t, 2*parallelThreshold)
+	send := func() []byte {
+		// The same IVs again, which the replay cache would otherwise refuse.
+		alice.Rand = &countingReader{}
+		alice.Replay = NewReplayCache()
+
+		var out []byte
+		alice.Out(func(b []byte) {
+			out = b
+		})
+		alice.SendMessage([]byte("hello"))
+		return out
+	}
+
+	defer func(w int, cpus func() int, procs int) {
+		parallelMinWork, numCPU = w, cpus
+		runtime.GOMAXPROCS(procs)
+	}(parallelMinWork, numCPU, runtime.GOMAXPROCS(4))
+
+	parallelMinWork = math.MaxInt32
+	sequential := send()
+
+	// Force goroutines even on a single core.
+	parallelMinWork = 0
+	numCPU = func() int { return 4 }
+	if p := send(); !sameJSON(t, p, sequential) {
+		t.Fatalf("parallel send differs:\n%s\n%s", p, sequential)
+	}
+}
+
+func TestSendRandFailure(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+	alice := n.members["alice"]
+
+	// Enough for one message to bob, and no more.
+	alice.Rand = bytes.NewReader(bytes.Repeat([]byte{1}, 64+12))
+	if err := alice.SendMessage([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendMessage([]byte("two")); err == nil || errors.Is(err, ErrStaleIV) {
+		t.Fatal("expected a read error, got", err)
+	}
+
+	// A reader stuck on the same bytes cannot give a fresh IV, and sending must give up rather than spin.
+	alice.Rand = zeroReader{}
+	if err := alice.SendMessage([]byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendMessage([]byte("four")); !errors.Is(err, ErrStaleIV) {
+		t.Fatal("expected ErrStaleIV, got", err)
+	}
+
+	// Long deterministic runs do not run out of IVs.
+	alice.Rand = &countingReader{}
+	for i := 0; i < 1000; i++ {
+		if err := alice.SendMessage([]byte("more")); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestResyncClock(t *testing.T) {
+	now := time.Now()
+	me, _ := NewMe("bob", "")
+	me.Clock = ClockFunc(func() time.Time { return now })
+
+	if !me.Resync("alice") || me.Resync("alice") {
+		t.Fatal("second resync should be throttled")
+	}
+
+	now = now.Add(DefaultResyncInterval)
+	if !me.Resync("alice") {
+		t.Fatal("resync should be allowed once the interval has passed")
+	}
+}
@@ -0,0 +1,141 @@
+package multiparty
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Every client strips this much random padding from the end of a message.
+const basePadding = 64
+
+// PaddingPolicy returns how many bytes of extra padding to put on a message of size bytes, on top of the 64 random bytes every message carries.
+// A nil policy adds none, which is what every other client does.
+//
+// Extra padding is made of spaces, which the web client does not display, and is announced in the last bytes of the random padding
+// so that go-cryptodog peers can remove it exactly. Other clients will see the spaces at the end of the message.
+// BEX packets never get extra padding, as other clients would read the spaces as part of them.
+type PaddingPolicy func(size int, rand io.Reader) int
+
+// Starts every BEX packet, as dog.BEX_MAGIC does.
+var bexMagic = []byte{0x04, 0x45, 0xFF}
+
+// Marks random padding that announces extra padding. It is followed by the amount as a big-endian uint32.
+var paddingMagic = []byte("\x00CDPAD\x00\x01")
+
+const paddingTrailer = 8 + 4
+
+// DefaultBuckets are the sizes BucketPadding uses when none are given. The largest fits within DefaultMaximumMessageSize.
+var DefaultBuckets = []int{128, 512, 1024, 2048, 4096}
+
+// BucketPadding pads each message up to the smallest bucket that fits it, so that only its bucket can be told from its length.
+// Messages larger than every bucket are sent without extra padding.
+func BucketPadding(buckets ...int) PaddingPolicy {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	return func(size int, _ io.Reader) int {
+		for _, b := range buckets {
+			if b >= size {
+				return b - size
+			}
+		}
+		return 0
+	}
+}
+
+// RandomPadding adds between 0 and max bytes of extra padding, chosen uniformly.
+func RandomPadding(max int) PaddingPolicy {
+	return func(size int, r io.Reader) int {
+		if max <= 0 {
+			return 0
+		}
+
+		n, err := rand.Int(r, big.NewInt(int64(max)+1))
+		if err != nil {
+			return 0
+		}
+		return int(n.Int64())
+	}
+}
+
+func (me *Me) maxMessageSize() int {
+	if me.MaximumMessageSize > 0 {
+		return me.MaximumMessageSize
+	}
+
+	return DefaultMaximumMessageSize
+}
+
+// MaxPlaintextSize is the largest message SendMessage will accept.
+func (me *Me) MaxPlaintextSize() int {
+	return me.maxMessageSize()/4*3 - basePadding
+}
+
+// pad returns message followed by padding, as it is to be encrypted. Peers refuse ciphertexts longer than their MaximumMessageSize,
+// so extra padding is trimmed to fit within ours, and a message that cannot fit at all is an error.
+func (me *Me) pad(message []byte) ([]byte, error) {
+	max := me.maxMessageSize()
+	if n := base64.StdEncoding.EncodedLen(len(message) + basePadding); n > max {
+		return nil, fmt.Errorf("%w: %d bytes would be %d once encrypted, and peers accept %d", ErrMessageTooLarge, len(message), n, max)
+	}
+
+	extra := 0
+	if me.Padding != nil && !bytes.HasPrefix(message, bexMagic) {
+		extra = me.Padding(len(message), me.rand())
+	}
+
+	if room := max/4*3 - len(message) - basePadding; extra > room {
+		extra = room
+	}
+	if extra < 0 {
+		extra = 0
+	}
+
+	padded := make([]byte, len(message)+extra+basePadding)
+	copy(padded, message)
+	for i := len(message); i < len(message)+extra; i++ {
+		padded[i] = ' '
+	}
+
+	trailer := padded[len(padded)-basePadding:]
+	if _, err := io.ReadFull(me.rand(), trailer); err != nil {
+		return nil, fmt.Errorf("multiparty: reading padding: %w", err)
+	}
+	if extra > 0 {
+		copy(trailer[basePadding-paddingTrailer:], paddingMagic)
+		binary.BigEndian.PutUint32(trailer[basePadding-4:], uint32(extra))
+	}
+
+	return padded, nil
+}
+
+// unpad removes the padding from a decrypted message, including any extra padding announced in it.
+func unpad(padded []byte) []byte {
+	if len(padded) < basePadding {
+		return nil
+	}
+
+	message := padded[:len(padded)-basePadding]
+	trailer := padded[len(padded)-basePadding:]
+	if !bytes.Equal(trailer[basePadding-paddingTrailer:basePadding-4], paddingMagic) {
+		return message
+	}
+
+	extra := binary.BigEndian.Uint32(trailer[basePadding-4:])
+	if uint64(extra) > uint64(len(message)) {
+		return message
+	}
+
+	spaces := message[len(message)-int(extra):]
+	if len(bytes.Trim(spaces, " ")) != 0 {
+		return message
+	}
+
+	return message[:len(message)-int(extra)]
+}
@@ -0,0 +1,90 @@
+package multiparty
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sentSize returns the length of the plaintext alice encrypted for bob, padding included.
+func sentSize(t *testing.T, n *testNet) int {
+	var a Answer
+	if err := json.Unmarshal(n.queue[len(n.queue)-1].data, &a); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := base64.StdEncoding.DecodeString(a.Text["bob"].Message)
+	return len(b)
+}
+
+func TestPadding(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy PaddingPolicy
+		check  func(size int) bool
+	}{
+		{"compatible", nil, func(size int) bool { return size == 8+64 }},
+		{"bucket", BucketPadding(), func(size int) bool { return size == 128+64 }},
+		{"random", RandomPadding(100), func(size int) bool { return size >= 8+64 && size <= 108+64 }},
+	} {
+		n := newTestNet(t, "alice", "bob")
+		n.members["alice"].Padding = tc.policy
+
+		// Trailing spaces of the sender's own are kept.
+		if err := n.members["alice"].SendMessage([]byte("padded  ")); err != nil {
+			t.Fatal(err)
+		}
+
+		if size := sentSize(t, n); !tc.check(size) {
+			t.Fatal(tc.name, "padding gave", size, "bytes")
+		}
+
+		n.flush()
+		if len(n.plaintexts["bob"]) != 1 || string(n.plaintexts["bob"][0]) != "padded  " {
+			t.Fatalf("%s: bob received %q", tc.name, n.plaintexts["bob"])
+		}
+	}
+}
+
+func TestPaddingSkipsBEX(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+	n.members["alice"].Padding = BucketPadding()
+
+	// The start of a BEX packet.
+	bex := []byte{0x04, 0x45, 0xFF, 0x01, 0x04}
+	if err := n.members["alice"].SendMessage(bex); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := sentSize(t, n); size != len(bex)+64 {
+		t.Fatal("binary message was padded to", size, "bytes")
+	}
+
+	n.flush()
+	if len(n.plaintexts["bob"]) != 1 || string(n.plaintexts["bob"][0]) != string(bex) {
+		t.Fatalf("bob received %q", n.plaintexts["bob"])
+	}
+}
+
+func TestSendSizeLimit(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+	alice := n.members["alice"]
+
+	if err := alice.SendMessage(make([]byte, DefaultMaximumMessageSize)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatal("expected ErrMessageTooLarge, got", err)
+	}
+
+	// Padding is trimmed rather than pushing a message over the limit.
+	alice.Padding = BucketPadding(1 << 20)
+	big := strings.Repeat("x", 4000)
+	if err := alice.SendMessage([]byte(big)); err != nil {
+		t.Fatal(err)
+	}
+
+	n.flush()
+	if len(n.errors["bob"]) > 0 || len(n.plaintexts["bob"]) != 1 || string(n.plaintexts["bob"][0]) != big {
+		t.Fatal("bob could not read the padded message", n.errors["bob"])
+	}
+}
@@ -0,0 +1,118 @@
+package multiparty
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"runtime"
+	"sync"
+)
+
+const (
+	// Below this many recipients, starting goroutines costs more than it saves.
+	parallelThreshold = 8
+
+	// Buffers larger than this are left for the garbage collector rather than pooled.
+	maxPooledBuffer = 1 << 20
+)
+
+// Bytes of work in total below which parallel runs calls in turn. A goroutine costs a few microseconds,
+// in which SHA-512 gets through a few kilobytes, so smaller jobs are not worth splitting.
+// These are variables so that tests and benchmarks can take either path.
+var (
+	parallelMinWork = 256 << 10
+	numCPU          = runtime.NumCPU
+)
+
+// parallel calls f for every i in [0, n), where each call processes about work bytes.
+// Large enough jobs are spread over up to GOMAXPROCS goroutines, but never more than there are CPUs:
+// on a single core the goroutines only add overhead. Calls must be independent of each other.
+func parallel(n, work int, f func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if cpus := numCPU(); workers > cpus {
+		workers = cpus
+	}
+	if workers > n {
+		workers = n
+	}
+
+	if n < parallelThreshold || workers <= 1 || n*work < parallelMinWork {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				f(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// getBuf returns an empty buffer from the pool. Return it with putBuf once nothing refers to it.
+func getBuf() *[]byte {
+	b := bufPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+func putBuf(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+
+	bufPool.Put(b)
+}
+
+// grow extends dst by n bytes, reallocating only if it lacks the capacity.
+func grow(dst []byte, n int) []byte {
+	if cap(dst)-len(dst) < n {
+		return append(dst, make([]byte, n)...)
+	}
+
+	return dst[:len(dst)+n]
+}
+
+// appendBase64 decodes s onto the end of dst. On error dst is returned unchanged.
+func appendBase64(dst []byte, s string) ([]byte, error) {
+	l := len(dst)
+	dst = grow(dst, base64.StdEncoding.DecodedLen(len(s)))
+
+	n, err := base64.StdEncoding.Decode(dst[l:], []byte(s))
+	if err != nil {
+		return dst[:l], err
+	}
+
+	return dst[:l+n], nil
+}
+
+// xorCTR encrypts or decrypts src into dst with AES-CTR. The first 12 bytes of iv are used, followed by a 32-bit counter starting at zero, as Cryptodog does.
+func xorCTR(dst, src, key, iv []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	var ctr [aes.BlockSize]byte
+	copy(ctr[:12], iv)
+	cipher.NewCTR(block, ctr[:]).XORKeyStream(dst, src)
+}
@@ -0,0 +1,143 @@
+package multiparty
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReplayWindow       = 30 * time.Minute
+	DefaultReplayMaxPerSender = 10000
+
+	// How many additions pass between sweeps of senders that have gone quiet.
+	replaySweepInterval = 4096
+)
+
+type seenIV struct {
+	iv   string
+	seen time.Time
+}
+
+type ivSet struct {
+	seen  map[string]struct{}
+	order []seenIV
+	head  int
+}
+
+func (s *ivSet) len() int {
+	return len(s.order) - s.head
+}
+
+// expire drops IVs older than the cutoff, and the oldest IVs beyond max.
+func (s *ivSet) expire(cutoff time.Time, max int) {
+	for s.len() > 0 && (s.order[s.head].seen.Before(cutoff) || s.len() > max) {
+		delete(s.seen, s.order[s.head].iv)
+		s.order[s.head] = seenIV{}
+		s.head++
+	}
+
+	// Compact once the dead prefix outweighs the live entries, so the cost stays amortized O(1).
+	if s.head > 0 && s.head >= s.len() {
+		s.order = s.order[:copy(s.order, s.order[s.head:])]
+		s.head = 0
+	}
+}
+
+// ReplayCache remembers the IVs each sender has used recently, with constant-time lookups.
+// An IV is forgotten once it is older than Window, or once its sender has used MaxPerSender newer ones,
+// after which a replay of the message that carried it is no longer detected.
+type ReplayCache struct {
+	Window       time.Duration
+	MaxPerSender int
+	// Defaults to SystemClock.
+	Clock Clock
+
+	l       sync.Mutex
+	senders map[string]*ivSet
+	adds    int
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{
+		Window:       DefaultReplayWindow,
+		MaxPerSender: DefaultReplayMaxPerSender,
+		senders:      make(map[string]*ivSet),
+	}
+}
+
+func (rc *ReplayCache) now() time.Time {
+	if rc.Clock != nil {
+		return rc.Clock.Now()
+	}
+
+	return SystemClock.Now()
+}
+
+// Seen reports whether sender has used iv within the window.
+func (rc *ReplayCache) Seen(sender, iv string) bool {
+	rc.l.Lock()
+	defer rc.l.Unlock()
+
+	s := rc.senders[sender]
+	if s == nil {
+		return false
+	}
+
+	s.expire(rc.now().Add(-rc.Window), rc.MaxPerSender)
+	_, ok := s.seen[iv]
+	return ok
+}
+
+// Add records that sender used iv. It returns false if the IV was already known, in which case the message carrying it is a replay.
+func (rc *ReplayCache) Add(sender, iv string) bool {
+	rc.l.Lock()
+	defer rc.l.Unlock()
+
+	now := rc.now()
+	cutoff := now.Add(-rc.Window)
+
+	s := rc.senders[sender]
+	if s == nil {
+		s = &ivSet{seen: make(map[string]struct{})}
+		rc.senders[sender] = s
+	}
+
+	// Leave room for the IV about to be added.
+	s.expire(cutoff, rc.MaxPerSender-1)
+
+	if _, ok := s.seen[iv]; ok {
+		return false
+	}
+
+	s.seen[iv] = struct{}{}
+	s.order = append(s.order, seenIV{iv, now})
+
+	rc.adds++
+	if rc.adds%replaySweepInterval == 0 {
+		rc.sweep(cutoff)
+	}
+
+	return true
+}
+
+// sweep expires every sender, forgetting senders with nothing left to remember.
+func (rc *ReplayCache) sweep(cutoff time.Time) {
+	for k, s := range rc.senders {
+		s.expire(cutoff, rc.MaxPerSender)
+		if s.len() == 0 {
+			delete(rc.senders, k)
+		}
+	}
+}
+
+// Len returns the number of IVs currently remembered.
+func (rc *ReplayCache) Len() int {
+	rc.l.Lock()
+	defer rc.l.Unlock()
+
+	n := 0
+	for _, s := range rc.senders {
+		n += s.len()
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package multiparty
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	rc := NewReplayCache()
+	rc.Clock = ClockFunc(func() time.Time { return now })
+	rc.MaxPerSender = 3
+
+	if !rc.Add("bob", "iv1") || rc.Add("bob", "iv1") {
+		t.Fatal("second use of an IV should be refused")
+	}
+
+	if !rc.Add("carol", "iv1") {
+		t.Fatal("IVs are tracked per sender")
+	}
+
+	rc.Add("bob", "iv2")
+	rc.Add("bob", "iv3")
+	rc.Add("bob", "iv4")
+
+	if rc.Seen("bob", "iv1") || !rc.Seen("bob", "iv4") {
+		t.Fatal("oldest IV should have been evicted")
+	}
+
+	now = now.Add(rc.Window + time.Second)
+	if rc.Seen("bob", "iv4") {
+		t.Fatal("IV should have expired")
+	}
+
+	for i := 0; i < replaySweepInterval; i++ {
+		rc.Add("dave", fmt.Sprint(i))
+	}
+
+	if rc.senders["bob"] != nil || rc.senders["carol"] != nil {
+		t.Fatal("idle senders should have been swept")
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+
+	var sent []byte
+	n.members["alice"].Out(func(b []byte) {
+		sent = b
+	})
+	n.members["alice"].SendMessage([]byte("once"))
+
+	if _, err := n.members["bob"].ReceiveMessage("alice", string(sent)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := n.members["bob"].ReceiveMessage("alice", string(sent)); err == nil {
+		t.Fatal("replayed message was accepted")
+	}
+}
+
+// preloadReplay fills rc with n IVs, spread over as many senders as it takes to keep them all under MaxPerSender.
+func preloadReplay(b *testing.B, rc *ReplayCache, n int) {
+	for i := 0; i < n; i++ {
+		rc.Add(fmt.Sprint("sender", i/rc.MaxPerSender), fmt.Sprint("preload", i))
+	}
+
+	if rc.Len() != n {
+		b.Fatal("preloaded", rc.Len(), "IVs, expected", n)
+	}
+}
+
+func BenchmarkReplayCache(b *testing.B) {
+	for _, preload := range []int{0, 1000000} {
+		b.Run(fmt.Sprintf("preload=%d", preload), func(b *testing.B) {
+			rc := NewReplayCache()
+			preloadReplay(b, rc, preload)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				iv := fmt.Sprint(i)
+				if rc.Seen("alice", iv) {
+					b.Fatal("unexpected hit")
+				}
+				rc.Add("alice", iv)
+			}
+		})
+	}
+}
+
+// Send and receive cost should not depend on how many messages came before.
+func BenchmarkSendReceive(b *testing.B) {
+	for _, preload := range []int{0, 1000000} {
+		b.Run(fmt.Sprintf("preload=%d", preload), func(b *testing.B) {
+			n := newTestNet(b, "alice", "bob")
+			alice, bob := n.members["alice"], n.members["bob"]
+
+			preloadReplay(b, alice.Replay, preload)
+			preloadReplay(b, bob.Replay, preload)
+
+			var sent []byte
+			alice.Out(func(d []byte) {
+				sent = d
+			})
+
+			msg := []byte("benchmark message")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				alice.SendMessage(msg)
+				if _, err := bob.ReceiveMessage("alice", string(sent)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Generates vectors.json, the test vectors used by vectors_test.go.
+//
+// This follows our reading of multiParty.js from the Cryptodog web client, using node:crypto instead of CryptoJS.
+// It is not the web client's code, and was written by the same people as the Go package, so the vectors are
+// self-derived: they share no code with the Go package, but they do share its understanding of the protocol.
+//
+//   - Keys are X25519. Alice and Bob use the keys from RFC 7748, section 6.1.
+//   - The fingerprint is the first 40 hex digits of SHA-512(public key), upper case.
+//   - SHA-512 of the shared secret gives the AES-256 key (first half) and the HMAC-SHA512 key (second half).
+//   - Messages are padded with 64 random bytes and encrypted with AES-CTR, using a 12 byte IV followed by a 32-bit counter starting at zero.
+//   - Each recipient's HMAC covers every recipient's ciphertext and IV, in sorted order.
+//   - The tag is SHA-512 applied eight times to the padded plaintext followed by every HMAC, in sorted order.
+//
+// Run it with `node vectors.js > vectors.json`. The output is deterministic.
+
+const crypto = require("crypto");
+
+const pkcs8 = Buffer.from("302e020100300506032b656e04220420", "hex");
+const spki = Buffer.from("302a300506032b656e032100", "hex");
+
+function identity(name, secretHex) {
+	const secret = Buffer.from(secretHex, "hex");
+	const key = crypto.createPrivateKey({ key: Buffer.concat([pkcs8, secret]), format: "der", type: "pkcs8" });
+	const pub = crypto.createPublicKey(key).export({ format: "der", type: "spki" }).subarray(-32);
+	return { name, secret, key, pub };
+}
+
+function fingerprint(pub) {
+	return crypto.createHash("sha512").update(pub).digest("hex").toUpperCase().slice(0, 40);
+}
+
+function sharedKeys(me, them) {
+	const publicKey = crypto.createPublicKey({ key: Buffer.concat([spki, them.pub]), format: "der", type: "spki" });
+	const secret = crypto.diffieHellman({ privateKey: me.key, publicKey });
+	const h = crypto.createHash("sha512").update(secret).digest();
+	return { message: h.subarray(0, 32), hmac: h.subarray(32) };
+}
+
+// Deterministic stand-ins for the random padding and IVs.
+function filler(label, n) {
+	const out = Buffer.alloc(n);
+	for (let i = 0, c = 0; i < n; c++) {
+		const h = crypto.createHash("sha256").update(label + ":" + c).digest();
+		i += h.copy(out, i);
+	}
+	return out;
+}
+
+function encrypt(sender, recipients, plaintext, padding, ivs) {
+	const padded = Buffer.concat([Buffer.from(plaintext, "utf8"), padding]);
+	const sorted = recipients.slice().sort((a, b) => (a.name < b.name ? -1 : a.name > b.name ? 1 : 0));
+
+	const text = {};
+	const parts = [];
+	for (const r of sorted) {
+		const keys = sharedKeys(sender, r);
+		const counter = Buffer.concat([ivs[r.name], Buffer.alloc(4)]);
+		const c = crypto.createCipheriv("aes-256-ctr", keys.message, counter);
+		const ct = Buffer.concat([c.update(padded), c.final()]);
+		text[r.name] = { message: ct.toString("base64"), iv: ivs[r.name].toString("base64") };
+		parts.push(ct, ivs[r.name]);
+	}
+
+	const covered = Buffer.concat(parts);
+	const macs = [];
+	for (const r of sorted) {
+		const mac = crypto.createHmac("sha512", sharedKeys(sender, r).hmac).update(covered).digest();
+		text[r.name].hmac = mac.toString("base64");
+		macs.push(mac);
+	}
+
+	let tag = Buffer.concat([padded, ...macs]);
+	for (let i = 0; i < 8; i++) {
+		tag = crypto.createHash("sha512").update(tag).digest();
+	}
+
+	return JSON.stringify({ type: "message", text, tag: tag.toString("base64") });
+}
+
+const alice = identity("alice", "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a");
+const bob = identity("bob", "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb");
+const carol = identity("Carol", crypto.createHash("sha256").update("carol").digest("hex"));
+const people = [alice, bob, carol];
+
+const out = {
+	identities: people.map((p) => ({
+		name: p.name,
+		secret: p.secret.toString("base64"),
+		public_key: p.pub.toString("base64"),
+		fingerprint: fingerprint(p.pub),
+		announcement: JSON.stringify({ type: "public_key", text: p.pub.toString("base64") }),
+	})),
+	shared: [],
+	messages: [],
+};
+
+for (const [a, b] of [[alice, bob], [alice, carol], [bob, carol]]) {
+	const k = sharedKeys(a, b);
+	out.shared.push({ a: a.name, b: b.name, message_key: k.message.toString("hex"), hmac_key: k.hmac.toString("hex") });
+}
+
+const cases = [
+	{ sender: alice, recipients: [bob], plaintext: "hello" },
+	// Carol sorts before the others, so the HMAC order differs from the order recipients are listed in.
+	{ sender: alice, recipients: [bob, carol], plaintext: "Multiparty \u{1f436} with two recipients" },
+	{ sender: bob, recipients: [carol, alice], plaintext: "" },
+	{ sender: carol, recipients: [alice, bob], plaintext: "x".repeat(200) },
+];
+
+cases.forEach((c, i) => {
+	const padding = filler("padding" + i, 64);
+	const ivs = {};
+	for (const r of c.recipients) {
+		ivs[r.name] = filler("iv" + i + r.name, 12);
+	}
+
+	out.messages.push({
+		sender: c.sender.name,
+		recipients: c.recipients.map((r) => r.name),
+		plaintext: c.plaintext,
+		padding: padding.toString("hex"),
+		ivs: Object.fromEntries(Object.entries(ivs).map(([k, v]) => [k, v.toString("hex")])),
+		message: encrypt(c.sender, c.recipients, c.plaintext, padding, ivs),
+	});
+});
+
+console.log(JSON.stringify(out, null, "\t"));
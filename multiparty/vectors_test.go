@@ -0,0 +1,228 @@
+package multiparty
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// vectors mirrors testdata/vectors.json, which is produced by testdata/vectors.js.
+//
+// The vectors are self-derived: vectors.js is our own Node rewrite of the protocol, written from the same reading of
+// the web client's multiParty.js as this package, not the web client itself and not captured traffic.
+// They catch mistakes in the Go code, but a misunderstanding shared by both would pass, so this is not a conformance suite.
+// Only the RFC 7748 shared secret checked in TestVectorKeys and the AES-CTR counter blocks checked in TestFixIV come from outside.
+// Transcripts captured from Cryptodog 2.5.0 and Cryptocat 2 have yet to be checked in.
+type vectors struct {
+	Identities []struct {
+		Name         string `json:"name"`
+		Secret       string `json:"secret"`
+		PublicKey    string `json:"public_key"`
+		Fingerprint  string `json:"fingerprint"`
+		Announcement string `json:"announcement"`
+	} `json:"identities"`
+	Shared []struct {
+		A          string `json:"a"`
+		B          string `json:"b"`
+		MessageKey string `json:"message_key"`
+		HMACKey    string `json:"hmac_key"`
+	} `json:"shared"`
+	Messages []struct {
+		Sender     string            `json:"sender"`
+		Recipients []string          `json:"recipients"`
+		Plaintext  string            `json:"plaintext"`
+		Padding    string            `json:"padding"`
+		IVs        map[string]string `json:"ivs"`
+		Message    string            `json:"message"`
+	} `json:"messages"`
+}
+
+func loadVectors(t *testing.T) (*vectors, map[string]string) {
+	b, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := new(vectors)
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := make(map[string]string)
+	for _, id := range v.Identities {
+		secrets[id.Name] = id.Secret
+	}
+
+	return v, secrets
+}
+
+// meet returns a Me for name that knows the public keys of others.
+func meet(t *testing.T, secrets map[string]string, name string, others ...string) *Me {
+	n := newTestNet(t)
+	for _, v := range append([]string{name}, others...) {
+		n.joinSecret(v, secrets[v])
+	}
+	n.flush()
+
+	for _, errs := range n.errors {
+		t.Fatal(errs)
+	}
+	return n.members[name]
+}
+
+func TestVectorKeys(t *testing.T) {
+	v, secrets := loadVectors(t)
+
+	for _, id := range v.Identities {
+		me, err := NewMe(id.Name, id.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pk := me.GetPublicKey()
+		if base64.StdEncoding.EncodeToString(pk[:]) != id.PublicKey {
+			t.Fatal(id.Name, "public key mismatch")
+		}
+
+		if me.Fingerprint("") != id.Fingerprint {
+			t.Fatal(id.Name, "fingerprint mismatch", me.Fingerprint(""))
+		}
+
+		var out []byte
+		me.Out(func(b []byte) {
+			out = b
+		})
+		me.SendPublicKey("")
+		if !sameJSON(t, out, []byte(id.Announcement)) {
+			t.Fatalf("%s announced %s, expected %s", id.Name, out, id.Announcement)
+		}
+	}
+
+	for _, s := range v.Shared {
+		for _, pair := range [][2]string{{s.A, s.B}, {s.B, s.A}} {
+			me := meet(t, secrets, pair[0], pair[1])
+			k := me.Buddies[pair[1]].MpSecretKey
+			if hex.EncodeToString(k.Message) != s.MessageKey || hex.EncodeToString(k.HMAC) != s.HMACKey {
+				t.Fatal("shared keys differ between", pair[0], "and", pair[1])
+			}
+		}
+	}
+
+	// The shared secret of the RFC 7748 keys used by alice and bob is published, so check it independently of the vectors.
+	rfc, _ := hex.DecodeString("4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")
+	sum := sha512.Sum512(rfc)
+	k := meet(t, secrets, "alice", "bob").Buddies["bob"].MpSecretKey
+	if !bytes.Equal(k.Message, sum[:32]) || !bytes.Equal(k.HMAC, sum[32:]) {
+		t.Fatal("alice and bob do not agree on the RFC 7748 shared secret")
+	}
+}
+
+func TestVectorReceive(t *testing.T) {
+	v, secrets := loadVectors(t)
+
+	for i, m := range v.Messages {
+		for _, r := range m.Recipients {
+			me := meet(t, secrets, r, m.Sender)
+
+			rcv, err := me.ReceiveMessage(m.Sender, m.Message)
+			if err != nil {
+				t.Fatal(i, r, err)
+			}
+
+			if rcv.Kind != Payload || string(rcv.Plaintext) != m.Plaintext {
+				t.Fatalf("message %d: %s decrypted %q", i, r, rcv.Plaintext)
+			}
+		}
+	}
+}
+
+func TestVectorSend(t *testing.T) {
+	v, secrets := loadVectors(t)
+
+	for i, m := range v.Messages {
+		me := meet(t, secrets, m.Sender, m.Recipients...)
+
+		// SendMessage reads the padding first, then one IV for each recipient in sorted order.
+		sorted := append([]string(nil), m.Recipients...)
+		sort.Strings(sorted)
+		random, _ := hex.DecodeString(m.Padding)
+		for _, r := range sorted {
+			iv, _ := hex.DecodeString(m.IVs[r])
+			random = append(random, iv...)
+		}
+		me.Rand = bytes.NewReader(random)
+
+		var out []byte
+		me.Out(func(b []byte) {
+			out = b
+		})
+		me.SendMessage([]byte(m.Plaintext))
+
+		if !sameJSON(t, out, []byte(m.Message)) {
+			t.Fatalf("message %d: sent\n%s\nexpected\n%s", i, out, m.Message)
+		}
+	}
+}
+
+// TestFixIV checks the counter block built from a message's IV against AES-CTR worked out by hand.
+// Like fixIV in multiParty.js, the first 12 bytes of the IV are followed by a 32-bit big-endian counter starting at zero,
+// whatever the sender put in the last 4 bytes. A shorter IV gives an all-zero counter block.
+func TestFixIV(t *testing.T) {
+	key := bytes.Repeat([]byte{0x2b}, 32)
+	nonce := []byte("twelve bytes")
+	src := bytes.Repeat([]byte{0xa5}, 40)
+
+	block, _ := aes.NewCipher(key)
+	keystream := func(prefix []byte) []byte {
+		var ks []byte
+		for i := uint32(0); len(ks) < len(src); i++ {
+			var ctr, out [aes.BlockSize]byte
+			copy(ctr[:12], prefix)
+			binary.BigEndian.PutUint32(ctr[12:], i)
+			block.Encrypt(out[:], ctr[:])
+			ks = append(ks, out[:]...)
+		}
+		return ks
+	}
+
+	for _, c := range []struct {
+		iv     []byte
+		prefix []byte
+	}{
+		{nonce, nonce},
+		{append(append([]byte(nil), nonce...), 0xde, 0xad, 0xbe, 0xef), nonce},
+		{nil, nil},
+	} {
+		ks := keystream(c.prefix)
+		want := make([]byte, len(src))
+		for i := range src {
+			want[i] = src[i] ^ ks[i]
+		}
+
+		got := make([]byte, len(src))
+		xorCTR(got, src, key, c.iv)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("iv %x: got %x, expected %x", c.iv, got, want)
+		}
+	}
+}
+
+// sameJSON compares two messages regardless of key order, which differs between Go and JavaScript.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
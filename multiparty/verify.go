@@ -0,0 +1,201 @@
+package multiparty
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// FingerprintWords renders a fingerprint with the PGP word list, one word per byte.
+// Bytes in even positions use the two-syllable list and bytes in odd positions the three-syllable one, so swapped or repeated words stand out when read aloud.
+func FingerprintWords(fp string) ([]string, error) {
+	b, err := hex.DecodeString(fp)
+	if err != nil {
+		return nil, fmt.Errorf("multiparty: invalid fingerprint: %s", err)
+	}
+
+	words := make([]string, len(b))
+	for i, v := range b {
+		if i%2 == 0 {
+			words[i] = pgpEven[v]
+		} else {
+			words[i] = pgpOdd[v]
+		}
+	}
+
+	return words, nil
+}
+
+// FingerprintQR renders a fingerprint as a QR code made of Unicode block characters, two rows of modules per line.
+// It is drawn for light text on a dark background, which is how most terminals are set up.
+func FingerprintQR(fp string) (string, error) {
+	if _, err := hex.DecodeString(fp); err != nil {
+		return "", fmt.Errorf("multiparty: invalid fingerprint: %s", err)
+	}
+
+	q, err := qrcode.New(strings.ToUpper(fp), qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+
+	bm := q.Bitmap()
+	var out bytes.Buffer
+	for y := 0; y < len(bm); y += 2 {
+		for x := range bm[y] {
+			top := !bm[y][x]
+			bottom := y+1 < len(bm) && !bm[y+1][x]
+
+			switch {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\n")
+	}
+
+	return out.String(), nil
+}
+
+// SAS is a short authentication string for a pair of public keys. Both sides compute the same one, and it is short enough to compare over a call.
+type SAS struct {
+	// Seven emoji, each carrying 6 bits.
+	Emoji []string
+	// The English names of the emoji, for clients that cannot show them.
+	Names []string
+	// Three numbers from 1000 to 9191, each carrying 13 bits.
+	Decimal [3]int
+}
+
+func (s SAS) String() string {
+	return fmt.Sprintf("%s (%s) %d-%d-%d", strings.Join(s.Emoji, " "), strings.Join(s.Names, ", "), s.Decimal[0], s.Decimal[1], s.Decimal[2])
+}
+
+// ComputeSAS derives the short authentication string for two public keys. The order of the keys does not matter.
+func ComputeSAS(a, b [32]byte) SAS {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+
+	h := sha512.New()
+	h.Write([]byte("Cryptodog SAS v1"))
+	h.Write(a[:])
+	h.Write(b[:])
+	sum := h.Sum(nil)
+
+	var s SAS
+	bits := binary.BigEndian.Uint64(sum[:8])
+	for i := 0; i < 7; i++ {
+		e := sasEmoji[bits>>(58-6*uint(i))&63]
+		s.Emoji = append(s.Emoji, e.emoji)
+		s.Names = append(s.Names, e.name)
+	}
+
+	bits = binary.BigEndian.Uint64(sum[8:16])
+	for i := range s.Decimal {
+		s.Decimal[i] = int(bits>>(51-13*uint(i))&0x1fff) + 1000
+	}
+
+	return s
+}
+
+// SAS returns the short authentication string between us and a buddy.
+func (me *Me) SAS(nick string) (SAS, error) {
+	me.lock()
+	defer me.unlock()
+
+	b := me.Buddies[nick]
+	if b == nil || !b.CryptoEnabled {
+		return SAS{}, fmt.Errorf("multiparty: no key for %s", nick)
+	}
+
+	return ComputeSAS(me.PublicKey, b.PublicKey), nil
+}
+
+// The PGP word list, indexed by byte value.
+var pgpEven = [256]string{
+	"aardvark", "absurd", "accrue", "acme", "adrift", "adult", "afflict", "ahead", "aimless", "Algol", "allow",
+	"alone", "ammo", "ancient", "apple", "artist", "assume", "Athens", "atlas", "Aztec", "baboon", "backfield",
+	"backward", "banjo", "beaming", "bedlamp", "beehive", "beeswax", "befriend", "Belfast", "berserk",
+	"billiard", "bison", "blackjack", "blockade", "blowtorch", "bluebird", "bombast", "bookshelf", "brackish",
+	"breadline", "breakup", "brickyard", "briefcase", "Burbank", "button", "buzzard", "cement", "chairlift",
+	"chatter", "checkup", "chisel", "choking", "chopper", "Christmas", "clamshell", "classic", "classroom",
+	"cleanup", "clockwork", "cobra", "commence", "concert", "cowbell", "crackdown", "cranky", "crowfoot",
+	"crucial", "crumpled", "crusade", "cubic", "dashboard", "deadbolt", "deckhand", "dogsled", "dragnet",
+	"drainage", "dreadful", "drifter", "dropper", "drumbeat", "drunken", "Dupont", "dwelling", "eating",
+	"edict", "egghead", "eightball", "endorse", "endow", "enlist", "erase", "escape", "exceed", "eyeglass",
+	"eyetooth", "facial", "fallout", "flagpole", "flatfoot", "flytrap", "fracture", "framework", "freedom",
+	"frighten", "gazelle", "Geiger", "glitter", "glucose", "goggles", "goldfish", "gremlin", "guidance",
+	"hamlet", "highchair", "hockey", "indoors", "indulge", "inverse", "involve", "island", "jawbone",
+	"keyboard", "kickoff", "kiwi", "klaxon", "locale", "lockup", "merit", "minnow", "miser", "Mohawk", "mural",
+	"music", "necklace", "Neptune", "newborn", "nightbird", "Oakland", "obtuse", "offload", "optic", "orca",
+	"payday", "peachy", "pheasant", "physique", "playhouse", "Pluto", "preclude", "prefer", "preshrunk",
+	"printer", "prowler", "pupil", "puppy", "python", "quadrant", "quiver", "quota", "ragtime", "ratchet",
+	"rebirth", "reform", "regain", "reindeer", "rematch", "repay", "retouch", "revenge", "reward", "rhythm",
+	"ribcage", "ringbolt", "robust", "rocker", "ruffled", "sailboat", "sawdust", "scallion", "scenic",
+	"scorecard", "Scotland", "seabird", "select", "sentence", "shadow", "shamrock", "showgirl", "skullcap",
+	"skydive", "slingshot", "slowdown", "snapline", "snapshot", "snowcap", "snowslide", "solo", "southward",
+	"soybean", "spaniel", "spearhead", "spellbind", "spheroid", "spigot", "spindle", "spyglass", "stagehand",
+	"stagnate", "stairway", "standard", "stapler", "steamship", "sterling", "stockman", "stopwatch", "stormy",
+	"sugar", "surmount", "suspense", "sweatband", "swelter", "tactics", "talon", "tapeworm", "tempest", "tiger",
+	"tissue", "tonic", "topmost", "tracker", "transit", "trauma", "treadmill", "Trojan", "trouble", "tumor",
+	"tunnel", "tycoon", "uncut", "unearth", "unwind", "uproot", "upset", "upshot", "vapor", "village", "virus",
+	"Vulcan", "waffle", "wallet", "watchword", "wayside", "willow", "woodlark", "Zulu",
+}
+
+var pgpOdd = [256]string{
+	"adroitness", "adviser", "aftermath", "aggregate", "alkali", "almighty", "amulet", "amusement", "antenna",
+	"applicant", "Apollo", "armistice", "article", "asteroid", "Atlantic", "atmosphere", "autopsy", "Babylon",
+	"backwater", "barbecue", "belowground", "bifocals", "bodyguard", "bookseller", "borderline", "bottomless",
+	"Bradbury", "bravado", "Brazilian", "breakaway", "Burlington", "businessman", "butterfat", "Camelot",
+	"candidate", "cannonball", "Capricorn", "caravan", "caretaker", "celebrate", "cellulose", "certify",
+	"chambermaid", "Cherokee", "Chicago", "clergyman", "coherence", "combustion", "commando", "company",
+	"component", "concurrent", "confidence", "conformist", "congregate", "consensus", "consulting", "corporate",
+	"corrosion", "councilman", "crossover", "crucifix", "cumbersome", "customer", "Dakota", "decadence",
+	"December", "decimal", "designing", "detector", "detergent", "determine", "dictator", "dinosaur",
+	"direction", "disable", "disbelief", "disruptive", "distortion", "document", "embezzle", "enchanting",
+	"enrollment", "enterprise", "equation", "equipment", "escapade", "Eskimo", "everyday", "examine",
+	"existence", "exodus", "fascinate", "filament", "finicky", "forever", "fortitude", "frequency", "gadgetry",
+	"Galveston", "getaway", "glossary", "gossamer", "graduate", "gravity", "guitarist", "hamburger", "Hamilton",
+	"handiwork", "hazardous", "headwaters", "hemisphere", "hesitate", "hideaway", "holiness", "hurricane",
+	"hydraulic", "impartial", "impetus", "inception", "indigo", "inertia", "infancy", "inferno", "informant",
+	"insincere", "insurgent", "integrate", "intention", "inventive", "Istanbul", "Jamaica", "Jupiter",
+	"leprosy", "letterhead", "liberty", "maritime", "matchmaker", "maverick", "Medusa", "megaton", "microscope",
+	"microwave", "midsummer", "millionaire", "miracle", "misnomer", "molasses", "molecule", "Montana",
+	"monument", "mosquito", "narrative", "nebula", "newsletter", "Norwegian", "October", "Ohio", "onlooker",
+	"opulent", "Orlando", "outfielder", "Pacific", "pandemic", "Pandora", "paperweight", "paragon", "paragraph",
+	"paramount", "passenger", "pedigree", "Pegasus", "penetrate", "perceptive", "performance", "pharmacy",
+	"phonetic", "photograph", "pioneer", "pocketful", "politeness", "positive", "potato", "processor",
+	"provincial", "proximate", "puberty", "publisher", "pyramid", "quantity", "racketeer", "rebellion",
+	"recipe", "recover", "repellent", "replica", "reproduce", "resistor", "responsive", "retraction",
+	"retrieval", "retrospect", "revenue", "revival", "revolver", "sandalwood", "sardonic", "Saturday",
+	"savagery", "scavenger", "sensation", "sociable", "souvenir", "specialist", "speculate", "stethoscope",
+	"stupendous", "supportive", "surrender", "suspicious", "sympathy", "tambourine", "telephone", "therapist",
+	"tobacco", "tolerance", "tomorrow", "torpedo", "tradition", "travesty", "trombonist", "truncated",
+	"typewriter", "ultimate", "undaunted", "underfoot", "unicorn", "unify", "universe", "unravel", "upcoming",
+	"vacancy", "vagabond", "vertigo", "Virginia", "visitor", "vocalist", "voyager", "warranty", "Waterloo",
+	"whimsical", "Wichita", "Wilmington", "Wyoming", "yesteryear", "Yucatan",
+}
+
+var sasEmoji = [64]struct {
+	emoji, name string
+}{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"}, {"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"}, {"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"}, {"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"}, {"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"}, {"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"}, {"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"}, {"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"}, {"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
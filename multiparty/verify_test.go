@@ -0,0 +1,70 @@
+package multiparty
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFingerprintWords(t *testing.T) {
+	words, err := FingerprintWords("E58294F2E9A227486E8B061B31CC528FD7FA3F19")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "topmost Istanbul Pluto vagabond treadmill Pacific brackish dictator goldfish Medusa afflict bravado chatter revolver Dupont midsummer stopwatch whimsical cowbell bottomless"
+	if s := strings.Join(words, " "); s != expect {
+		t.Fatal("got", s)
+	}
+
+	if _, err := FingerprintWords("not hex"); err == nil {
+		t.Fatal("invalid fingerprint was accepted")
+	}
+}
+
+func TestSAS(t *testing.T) {
+	n := newTestNet(t, "alice", "bob")
+	alice, bob := n.members["alice"], n.members["bob"]
+
+	a, err := alice.SAS("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := bob.SAS("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.String() != b.String() || len(a.Emoji) != 7 {
+		t.Fatal("mismatched SAS", a, b)
+	}
+
+	for _, d := range a.Decimal {
+		if d < 1000 || d > 9191 {
+			t.Fatal("decimal out of range", d)
+		}
+	}
+
+	if _, err := alice.SAS("carol"); err == nil {
+		t.Fatal("SAS for an unknown buddy")
+	}
+}
+
+func TestFingerprintQR(t *testing.T) {
+	qr, err := FingerprintQR("E58294F2E9A227486E8B061B31CC528FD7FA3F19")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(qr, "\n"), "\n")
+	if len(lines) < 10 {
+		t.Fatal("QR code too small", len(lines))
+	}
+
+	for _, l := range lines {
+		if utf8.RuneCountInString(l) != utf8.RuneCountInString(lines[0]) {
+			t.Fatal("ragged QR code")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package xmpp
+
+import "fmt"
+
+const NSChatStates = "http://jabber.org/protocol/chatstates"
+
+// ChatState is an XEP-0085 chat state notification.
+type ChatState string
+
+const (
+	NoChatState   ChatState = ""
+	ChatActive    ChatState = "active"
+	ChatComposing ChatState = "composing"
+	ChatPaused    ChatState = "paused"
+	ChatInactive  ChatState = "inactive"
+	ChatGone      ChatState = "gone"
+)
+
+const SendChatStateStanza = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' xmlns='jabber:client'><%s xmlns='http://jabber.org/protocol/chatstates'/></message>"
+
+func (cs ChatState) Valid() bool {
+	switch cs {
+	case ChatActive, ChatComposing, ChatPaused, ChatInactive, ChatGone:
+		return true
+	}
+
+	return false
+}
+
+// State returns the chat state carried by the message, or NoChatState.
+// XEP-0085 elements take precedence over the legacy jabber:x:event form.
+func (m Message) State() ChatState {
+	for _, v := range m.Extra {
+		if v.XMLName.Space != NSChatStates {
+			continue
+		}
+
+		if cs := ChatState(v.XMLName.Local); cs.Valid() {
+			return cs
+		}
+	}
+
+	if m.X.Composing != nil {
+		return ChatComposing
+	}
+
+	if m.X.Paused != nil {
+		return ChatPaused
+	}
+
+	return NoChatState
+}
+
+// SendChatState sends a standalone chat state notification.
+// Composing and paused notifications also carry the legacy forms understood by older clients.
+func (c *Conn) SendChatState(jid, typeof string, state ChatState) error {
+	if c == nil {
+		return fmt.Errorf("xmpp: conn is nil")
+	}
+
+	switch state {
+	case ChatComposing:
+		return c.SendComposing(jid, typeof)
+	case ChatPaused:
+		return c.SendPaused(jid, typeof)
+	}
+
+	if !state.Valid() {
+		return fmt.Errorf("xmpp: invalid chat state %q", state)
+	}
+
+	return c.send(Stanza{
+		Recipient: jid,
+		Type:      typeof,
+		JID:       c.JID,
+	}.Render(fmt.Sprintf(SendChatStateStanza, state)))
+}
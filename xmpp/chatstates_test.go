@@ -0,0 +1,31 @@
+package xmpp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestChatState(t *testing.T) {
+	for _, v := range []struct {
+		stanza string
+		state  ChatState
+	}{
+		{`<message from='lobby@conference.crypto.dog/bob' type='groupchat' xmlns='jabber:client'><composing xmlns='http://jabber.org/protocol/chatstates'/></message>`, ChatComposing},
+		{`<message from='lobby@conference.crypto.dog/bob' type='chat' id='abc123' xmlns='jabber:client'><body>hi</body><active xmlns='http://jabber.org/protocol/chatstates'/></message>`, ChatActive},
+		{`<message from='lobby@conference.crypto.dog/bob' type='chat' xmlns='jabber:client'><gone xmlns='http://jabber.org/protocol/chatstates'/></message>`, ChatGone},
+		{`<message from='lobby@conference.crypto.dog/bob' type='groupchat' xmlns='jabber:client'><paused xmlns='urn:example:other'/></message>`, NoChatState},
+		{`<message from='lobby@conference.crypto.dog/bob' type='groupchat' xmlns='jabber:client'><body/><x xmlns='jabber:x:event'><paused/></x></message>`, ChatPaused},
+		{Stanza{Recipient: "lobby@conference.crypto.dog", Type: "groupchat"}.Render(SendComposingStanza), ChatComposing},
+		{Stanza{Recipient: "lobby@conference.crypto.dog", Type: "groupchat", Body: "hi"}.Render(SendMessageStanza), ChatActive},
+		{Stanza{Recipient: "lobby@conference.crypto.dog", Type: "chat"}.Render(fmt.Sprintf(SendChatStateStanza, ChatInactive)), ChatInactive},
+	} {
+		msg, err := ParseMessage(v.stanza)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st := msg.State(); st != v.state {
+			t.Fatalf("Got %q should have been %q in %s", st, v.state, v.stanza)
+		}
+	}
+}
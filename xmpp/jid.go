@@ -1,50 +1,197 @@
 package xmpp
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"github.com/superp00t/etc"
+	"golang.org/x/text/secure/precis"
 )
 
+// JID is an XMPP address as described by RFC 7622: [localpart@]domainpart[/resourcepart]
 type JID struct {
-	Local string
-	Host  string
-	Node  string
+	Local    string
+	Domain   string
+	Resource string
 }
 
+// Maximum length in bytes of each part of a JID.
+const MaxJIDPartSize = 1023
+
+var (
+	InvalidJID = errors.New("xmpp: invalid jid")
+)
+
+// ParseJID splits s into its parts and prepares each one, returning an error wrapping InvalidJID if any part is invalid.
 func ParseJID(s string) (JID, error) {
-	if !strings.Contains(s, "@") {
-		return JID{}, fmt.Errorf("xmpp: could not parse jid without @")
+	j := JID{}
+	rest := s
+
+	if i := strings.IndexByte(rest, '/'); i != -1 {
+		j.Resource = rest[i+1:]
+		rest = rest[:i]
+
+		if j.Resource == "" {
+			return JID{}, fmt.Errorf("%w: empty resourcepart in %q", InvalidJID, s)
+		}
 	}
 
-	j := JID{}
+	if i := strings.IndexByte(rest, '@'); i != -1 {
+		j.Local = rest[:i]
+		rest = rest[i+1:]
+
+		if j.Local == "" {
+			return JID{}, fmt.Errorf("%w: empty localpart in %q", InvalidJID, s)
+		}
+	}
+
+	j.Domain = rest
+
+	return NewJID(j.Local, j.Domain, j.Resource)
+}
+
+// NewJID prepares and validates each part of a JID. local and resource may be empty.
+func NewJID(local, domain, resource string) (JID, error) {
+	var j JID
+	var err error
+
+	if local != "" {
+		if j.Local, err = PrepareLocal(local); err != nil {
+			return JID{}, err
+		}
+	}
+
+	if j.Domain, err = PrepareDomain(domain); err != nil {
+		return JID{}, err
+	}
+
+	if resource != "" {
+		if j.Resource, err = PrepareResource(resource); err != nil {
+			return JID{}, err
+		}
+	}
+
+	return j, nil
+}
 
-	spl := strings.SplitN(s, "@", 2)
-	j.Local = spl[0]
+// MUCJID returns the address of a multi-user chat room, or of one of its occupants if nick is not empty.
+// The room name is escaped according to XEP-0106 and the nickname is prepared according to RFC 8266.
+func MUCJID(room, conference, nick string) (JID, error) {
+	local, err := PrepareRoom(room)
+	if err != nil {
+		return JID{}, err
+	}
+
+	domain, err := PrepareDomain(conference)
+	if err != nil {
+		return JID{}, err
+	}
 
-	if strings.Contains(spl[1], "/") {
-		split := strings.SplitN(spl[1], "/", 2)
-		j.Host = split[0]
-		j.Node = split[1]
-	} else {
-		j.Host = spl[1]
+	j := JID{
+		Local:  local,
+		Domain: domain,
+	}
+
+	if nick != "" {
+		if j.Resource, err = PrepareNickname(nick); err != nil {
+			return JID{}, err
+		}
 	}
 
 	return j, nil
 }
 
+// PrepareLocal enforces the UsernameCaseMapped profile on a localpart, as required by RFC 7622.
+func PrepareLocal(s string) (string, error) {
+	p, err := precis.UsernameCaseMapped.String(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: localpart %q: %s", InvalidJID, s, err)
+	}
+
+	if strings.ContainsAny(p, `"&'/:<>@`) {
+		return "", fmt.Errorf("%w: localpart %q contains a disallowed character", InvalidJID, s)
+	}
+
+	return p, checkLength("localpart", p)
+}
+
+// PrepareRoom escapes a room name according to XEP-0106 and prepares it for use as a localpart.
+func PrepareRoom(room string) (string, error) {
+	if room == "" {
+		return "", fmt.Errorf("%w: empty room name", InvalidJID)
+	}
+
+	if strings.HasPrefix(room, " ") || strings.HasSuffix(room, " ") {
+		return "", fmt.Errorf("%w: room name %q begins or ends with a space", InvalidJID, room)
+	}
+
+	return PrepareLocal(EscapeLocal(room))
+}
+
+// PrepareDomain lowercases a domainpart and rejects characters that cannot appear in a host name.
+func PrepareDomain(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if s == "" {
+		return "", fmt.Errorf("%w: empty domainpart", InvalidJID)
+	}
+
+	if strings.ContainsAny(s, "@/\\ \t\r\n") {
+		return "", fmt.Errorf("%w: domainpart %q contains a disallowed character", InvalidJID, s)
+	}
+
+	return s, checkLength("domainpart", s)
+}
+
+// PrepareResource enforces the OpaqueString profile on a resourcepart, as required by RFC 7622.
+func PrepareResource(s string) (string, error) {
+	p, err := precis.OpaqueString.String(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: resourcepart %q: %s", InvalidJID, s, err)
+	}
+
+	return p, checkLength("resourcepart", p)
+}
+
+// PrepareNickname enforces the RFC 8266 Nickname profile, which XEP-0045 recommends for room nicknames.
+func PrepareNickname(s string) (string, error) {
+	p, err := precis.Nickname.String(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: nickname %q: %s", InvalidJID, s, err)
+	}
+
+	return PrepareResource(p)
+}
+
+func checkLength(part, s string) error {
+	if len(s) > MaxJIDPartSize {
+		return fmt.Errorf("%w: %s is longer than %d bytes", InvalidJID, part, MaxJIDPartSize)
+	}
+
+	return nil
+}
+
 func (j JID) String() string {
-	str := j.Local + "@" + j.Host
+	str := j.Domain
 
-	if j.Node != "" {
-		str += "/" + j.Node
+	if j.Local != "" {
+		str = j.Local + "@" + str
+	}
+
+	if j.Resource != "" {
+		str += "/" + j.Resource
 	}
 
 	return str
 }
 
+// Bare returns the JID without its resourcepart.
+func (j JID) Bare() JID {
+	j.Resource = ""
+	return j
+}
+
 func UnescapeLocal(s string) string {
 	e := etc.FromString(s)
 	o := etc.NewBuffer()
@@ -56,7 +203,7 @@ mainLoop:
 			return o.ToString()
 		}
 
-		if rn == '\\' {
+		if rn == '\\' && e.Available() >= 2 {
 			chr := `\` + e.ReadFixedString(2)
 
 			for k, v := range charsLookup {
@@ -65,6 +212,10 @@ mainLoop:
 					goto mainLoop
 				}
 			}
+
+			// Not an escape sequence, leave it as it was.
+			o.Write([]byte(chr))
+			continue
 		}
 
 		o.WriteRune(rn)
@@ -86,9 +237,25 @@ var charsLookup = map[rune]string{
 	'\\': "\\5c",
 }
 
+func isEscapeSequence(s string) bool {
+	for _, v := range charsLookup {
+		if strings.HasPrefix(s, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EscapeLocal applies XEP-0106 escaping. A backslash is only escaped when it would otherwise be read as the start of an escape sequence.
 func EscapeLocal(s string) string {
 	out := etc.NewBuffer()
-	for _, v := range []rune(s) {
+	for i, v := range s {
+		if v == '\\' && !isEscapeSequence(s[i:]) {
+			out.WriteRune(v)
+			continue
+		}
+
 		if charsLookup[v] != "" {
 			out.Write([]byte(charsLookup[v]))
 		} else {
@@ -1,6 +1,9 @@
 package xmpp
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 var testData = [][2]string{
 	{"testing testing", `testing\20testing`},
@@ -22,3 +25,65 @@ func TestUnescape(t *testing.T) {
 		}
 	}
 }
+
+func TestEscapeBackslash(t *testing.T) {
+	for _, v := range [][2]string{
+		{`c:\net`, `c\3a\net`},
+		{`c:\5cnet`, `c\3a\5c5cnet`},
+	} {
+		if esc := EscapeLocal(v[0]); esc != v[1] {
+			t.Fatal("Got", esc, "should have been", v[1])
+		}
+
+		if unesc := UnescapeLocal(v[1]); unesc != v[0] {
+			t.Fatal("Got", unesc, "should have been", v[0])
+		}
+	}
+}
+
+func TestParseJID(t *testing.T) {
+	j, err := ParseJID("Lobby@Conference.Crypto.Dog/Some Nick")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Local != "lobby" || j.Domain != "conference.crypto.dog" || j.Resource != "Some Nick" {
+		t.Fatal("Got", j.Local, j.Domain, j.Resource)
+	}
+
+	if j, err := ParseJID("crypto.dog"); err != nil || j.String() != "crypto.dog" {
+		t.Fatal("domain-only jid should parse", j, err)
+	}
+
+	if j, err := ParseJID("a@b/c/d"); err != nil || j.Resource != "c/d" {
+		t.Fatal("resource may contain a slash", j, err)
+	}
+
+	for _, v := range []string{
+		"@crypto.dog",
+		"lobby@crypto.dog/",
+		"lob by@crypto.dog",
+		"lobby@",
+	} {
+		if _, err := ParseJID(v); !errors.Is(err, InvalidJID) {
+			t.Fatal(v, "should not have parsed, got", err)
+		}
+	}
+}
+
+func TestMUCJID(t *testing.T) {
+	j, err := MUCJID("my room", "conference.crypto.dog", "  bob  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := j.String(); s != `my\20room@conference.crypto.dog/bob` {
+		t.Fatal("Got", s)
+	}
+
+	for _, v := range []string{"", " lobby", "lobby\u0000"} {
+		if _, err := MUCJID(v, "conference.crypto.dog", "bob"); err == nil {
+			t.Fatalf("room name %q should have been rejected", v)
+		}
+	}
+}
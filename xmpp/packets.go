@@ -2,6 +2,7 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"fmt"
 
 	"github.com/beevik/etree"
 )
@@ -36,6 +37,9 @@ func Parse(data string) (interface{}, error) {
 	}
 
 	root := doc.Root()
+	if root == nil {
+		return nil, fmt.Errorf("xmpp: no root element")
+	}
 
 	switch root.Tag {
 	case "iq":
@@ -0,0 +1,49 @@
+package xmpp
+
+import (
+	"runtime"
+	"testing"
+)
+
+var stanzaSeeds = []string{
+	`<message from='lobby@conference.crypto.dog/alice' to='bot@crypto.dog' type='groupchat' xmlns='jabber:client'><body>{"type":"public_key","text":"aGVsbG8="}</body></message>`,
+	`<message type='error' xmlns='jabber:client'><error code='500'><text>Traffic rate limit is exceeded</text></error></message>`,
+	`<presence from='lobby@conference.crypto.dog/bob' xmlns='jabber:client'><x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='none' role='participant'/></x></presence>`,
+	`<presence from='lobby@conference.crypto.dog/bot' type='error' xmlns='jabber:client'><error code='409' type='cancel'/></presence>`,
+	`<presence from='lobby@conference.crypto.dog/bob' type='unavailable'/>`,
+	`<iq type='get' id='ping1' xmlns='jabber:client'><ping xmlns='urn:xmpp:ping'/></iq>`,
+	`<presence from='lobby@conference.crypto.dog/bot' type='error'/>`,
+	`<!-- nothing here -->`,
+}
+
+func FuzzParse(f *testing.F) {
+	for _, v := range stanzaSeeds {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		Parse(data)
+	})
+}
+
+func FuzzRecv(f *testing.F) {
+	for _, v := range stanzaSeeds {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		sock := newFakeSocket()
+		c := newConn(sock, Opts{Host: "crypto.dog"})
+		defer c.Disconnect()
+
+		// Close the socket once the stanza has been read, in case Recv goes back for another.
+		sock.in <- []byte(data)
+		go func() {
+			for len(sock.in) > 0 {
+				runtime.Gosched()
+			}
+			sock.Close()
+		}()
+		c.Recv()
+	})
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"html/template"
 	"net/url"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/superp00t/etc/yo"
@@ -21,15 +24,32 @@ const (
 	SessStanza          = "<iq type='set' id='_session_auth_2' xmlns='jabber:client'><session xmlns='urn:ietf:params:xml:ns:xmpp-session'/></iq>"
 	JoinMucStanza       = "<presence from='{{.JID}}' to='{{.MUCJID}}' xmlns='jabber:client'><x xmlns='http://jabber.org/protocol/muc'/></presence>"
 	JoinMucStanza2      = "<presence from='{{.JID}}' to='{{.MUCJID}}' xmlns='jabber:client'><show/><status/></presence>"
-	SendMessageStanza   = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' xmlns='jabber:client'><body xmlns='jabber:client'>{{.Body}}</body><x xmlns='jabber:x:event'><active/></x></message>"
-	SendComposingStanza = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' id='composing' xmlns='jabber:client'><body/><x xmlns='jabber:x:event'><composing xmlns='http://jabber.org/protocol/chatstates'/></x></message>"
-	SendPausedStanza    = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' id='paused' xmlns='jabber:client'><body/><x xmlns='jabber:x:event'><paused xmlns='http://jabber.org/protocol/chatstates'/></x></message>"
+	SendMessageStanza   = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' xmlns='jabber:client'><body xmlns='jabber:client'>{{.Body}}</body><active xmlns='http://jabber.org/protocol/chatstates'/><x xmlns='jabber:x:event'><active/></x></message>"
+	SendComposingStanza = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' id='composing' xmlns='jabber:client'><body/><composing xmlns='http://jabber.org/protocol/chatstates'/><x xmlns='jabber:x:event'><composing xmlns='http://jabber.org/protocol/chatstates'/></x></message>"
+	SendPausedStanza    = "<message to='{{.Recipient}}' from='{{.JID}}' type='{{.Type}}' id='paused' xmlns='jabber:client'><body/><paused xmlns='http://jabber.org/protocol/chatstates'/><x xmlns='jabber:x:event'><paused xmlns='http://jabber.org/protocol/chatstates'/></x></message>"
 	KickUserStanza      = `<iq from='{{.JID}}' id='kick1' to='{{.MUCJID}}' type='set'><query xmlns='http://jabber.org/protocol/muc#admin'><item nick='{{.Nick}}' role='none'><reason>{{.Reason}}</reason></item></query></iq>`
 	PingResponse        = `<iq type='result' to='{{.Host}}' id='{{.Id}}' xmlns='jabber:client'/>`
 )
 
+// Stanzas larger than this many bytes are subject to the OversizedPolicy, unless Opts.MaxStanzaSize says otherwise.
+const DefaultMaxStanzaSize = 75000
+
 var (
-	RateLimited = errors.New("xmpp: rate limited")
+	RateLimited    = errors.New("xmpp: rate limited")
+	StanzaTooLarge = errors.New("xmpp: stanza too large")
+	Closed         = errors.New("xmpp: connection closed")
+)
+
+// OversizedPolicy decides what Recv does with a stanza that exceeds the maximum size.
+type OversizedPolicy int
+
+const (
+	// Recv returns an OversizedStanza in place of the stanza.
+	DropOversized OversizedPolicy = iota
+	// The stanza is processed as normal.
+	AcceptOversized
+	// Recv returns an OversizedStanza along with the StanzaTooLarge error.
+	DisconnectOversized
 )
 
 type Presence struct {
@@ -49,12 +69,20 @@ type Message struct {
 	Body    string `xml:"body"`
 	Error   Error  `xml:"error"`
 	X       Event  `xml:"x"`
+	// Every other child element, among them XEP-0085 chat states. See State.
+	Extra []Element `xml:",any"`
+}
+
+type Element struct {
+	XMLName xml.Name
 }
 
 type Error struct {
 	Code int    `xml:"code"`
 	Text string `xml:"text"`
 }
+
+// Legacy XEP-0022 message events, still sent by older Cryptodog and Cryptocat clients.
 type Event struct {
 	Composing *string `xml:"composing"`
 	Paused    *string `xml:"paused"`
@@ -89,26 +117,101 @@ type Bind struct {
 }
 
 type Opts struct {
+	// Debug prints every stanza to stdout, unless Tracer is set.
 	Debug              bool
 	URL                string
 	Host               string
 	Username, Password string
 	Proxy              string
+
+	Tracer          Tracer
+	MaxStanzaSize   int
+	OversizedPolicy OversizedPolicy
+	// Number of stanzas that may wait to be written before senders block. Defaults to DefaultSendQueueSize.
+	SendQueueSize int
 }
 
+const DefaultSendQueueSize = 64
+
+// socket carries whole stanzas to and from the server. Dial uses a websocket.
+type socket interface {
+	Send([]byte) error
+	Recv() ([]byte, error)
+	Close()
+}
+
+type wsSocket struct {
+	*ws.Conn
+}
+
+func (w wsSocket) Close() {
+	w.Conn.Close()
+}
+
+type outgoing struct {
+	data []byte
+	errc chan error
+}
+
+// Conn is an XMPP client connection. Its methods may be called from multiple goroutines,
+// all writes are serialized through a single writer goroutine. Recv must only be called from one goroutine at a time.
 type Conn struct {
-	JID      string
-	Opts     Opts
-	socket   *ws.Conn
-	lastRecv time.Time
+	JID    string
+	Opts   Opts
+	socket socket
+
+	out       chan outgoing
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(s socket, o Opts) *Conn {
+	if o.Debug && o.Tracer == nil {
+		o.Tracer = TextTracer(os.Stdout)
+	}
+
+	if o.SendQueueSize <= 0 {
+		o.SendQueueSize = DefaultSendQueueSize
+	}
+
+	c := &Conn{
+		socket: s,
+		Opts:   o,
+		out:    make(chan outgoing, o.SendQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go c.writer()
+
+	return c
+}
+
+func (c *Conn) writer() {
+	for {
+		select {
+		case o := <-c.out:
+			// Traced here rather than by the sender, so that traces come out in the order stanzas are written.
+			c.trace(Outbound, string(o.data))
+			o.errc <- c.socket.Send(o.data)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.socket.Close()
+	})
 }
 
 func (c *Conn) Disconnect() {
 	if c == nil {
 		return
 	}
-	c.socket.Send([]byte(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing" />`))
-	c.socket.Close()
+	c.send(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing" />`)
+	c.close()
 }
 
 func (s Stanza) Render(st string) string {
@@ -147,15 +250,12 @@ func Dial(o Opts) (*Conn, error) {
 		return nil, err
 	}
 
-	cli := &Conn{
-		socket:   c,
-		Opts:     o,
-		lastRecv: time.Now(),
-	}
+	cli := newConn(wsSocket{c}, o)
 
 	if o.Username == "" {
 		cli.send(Stanza{Host: o.Host}.Render(OpenStanza))
 	} else {
+		cli.close()
 		return nil, fmt.Errorf("Authenticated login not yet implemented")
 	}
 
@@ -178,57 +278,97 @@ func Dial(o Opts) (*Conn, error) {
 	return cli, nil
 }
 
+func (c *Conn) trace(d Direction, stanza string) {
+	if c.Opts.Tracer != nil {
+		c.Opts.Tracer.Trace(Trace{
+			Direction: d,
+			Time:      time.Now(),
+			Stanza:    stanza,
+		})
+	}
+}
+
 func (c *Conn) send(stanza string) error {
-	if c.Opts.Debug {
-		PrintTree(stanza)
+	o := outgoing{
+		data: []byte(stanza),
+		errc: make(chan error, 1),
 	}
-	err := c.socket.Send([]byte(stanza))
-	if err != nil {
-		yo.Warn(err)
-		return err
+
+	select {
+	case c.out <- o:
+	case <-c.done:
+		return Closed
+	}
+
+	select {
+	case err := <-o.errc:
+		if err != nil {
+			yo.Warn(err)
+			return err
+		}
+	case <-c.done:
+		return Closed
 	}
 
 	return nil
 }
 
 func (c *Conn) recv() (string, error) {
-start:
 	_stanza, err := c.socket.Recv()
 	if err != nil {
 		return "", err
 	}
 
-	if len(_stanza) > 75000 {
-		if c.Opts.Debug {
-			fmt.Println("Stanza length", len(_stanza), "time", time.Since(c.lastRecv))
-		}
-		c.lastRecv = time.Now()
-		goto start
-	}
-
 	stanza := string(_stanza)
 
-	if c.Opts.Debug {
-		PrintTree(stanza)
-	}
+	c.trace(Inbound, stanza)
 
 	return stanza, nil
 }
 
-func (c *Conn) JoinMUC(room, conference, nick string) {
-	mjid := JID{
-		Local: room,
-		Host:  conference,
-		Node:  nick,
+// JoinMUC enters a room under the nickname in mjid, which should come from MUCJID.
+func (c *Conn) JoinMUC(mjid JID) error {
+	if c == nil {
+		return fmt.Errorf("xmpp: conn is nil")
 	}
+
 	c.send(Stanza{JID: c.JID, MUCJID: mjid.String()}.Render(JoinMucStanza))
 	c.send(Stanza{JID: c.JID, MUCJID: mjid.String()}.Render(JoinMucStanza2))
+	return nil
 }
 
 type NicknameInUse struct {
 	JID
 }
 
+type OversizedStanza struct {
+	From string
+	Size int
+}
+
+var fromRgx = regexp.MustCompile(`^<[^>]*?\sfrom=['"]([^'"]*)['"]`)
+
+func peekFrom(stanza string) string {
+	if len(stanza) > 1024 {
+		stanza = stanza[:1024]
+	}
+
+	m := fromRgx.FindStringSubmatch(stanza)
+	if m == nil {
+		return ""
+	}
+
+	return m[1]
+}
+
+func (c *Conn) maxStanzaSize() int {
+	if c.Opts.MaxStanzaSize > 0 {
+		return c.Opts.MaxStanzaSize
+	}
+
+	return DefaultMaxStanzaSize
+}
+
 func (c *Conn) Recv() (interface{}, error) {
 rcv:
 	str, err := c.recv()
@@ -236,6 +376,20 @@ rcv:
 		return nil, err
 	}
 
+	if len(str) > c.maxStanzaSize() {
+		over := OversizedStanza{
+			From: peekFrom(str),
+			Size: len(str),
+		}
+
+		switch c.Opts.OversizedPolicy {
+		case DropOversized:
+			return over, nil
+		case DisconnectOversized:
+			return over, StanzaTooLarge
+		}
+	}
+
 	if strings.HasPrefix(str, "<presence") {
 		pres, err := ParsePresence(str)
 		if err != nil {
@@ -243,6 +397,9 @@ rcv:
 		}
 
 		if pres.Type == "error" {
+			if pres.Error == nil {
+				return nil, fmt.Errorf("xmpp: presence error from %q", pres.From)
+			}
 			if pres.Error.Code == 409 {
 				yo.L(4).Warn(str)
 				j, _ := ParseJID(pres.From)
@@ -311,6 +468,10 @@ func (c *Conn) SendComposing(jid, typeof string) error {
 }
 
 func (c *Conn) SendPaused(jid, typeof string) error {
+	if c == nil {
+		return fmt.Errorf("xmpp: conn is nil")
+	}
+
 	return c.send(Stanza{
 		Recipient: jid,
 		Type:      typeof,
@@ -319,11 +480,14 @@ func (c *Conn) SendPaused(jid, typeof string) error {
 }
 
 func (c *Conn) Kick(lobby, nick, reason string) error {
-	c.send(Stanza{
+	if c == nil {
+		return fmt.Errorf("xmpp: conn is nil")
+	}
+
+	return c.send(Stanza{
 		JID:    c.JID,
 		MUCJID: lobby,
 		Nick:   nick,
 		Reason: reason,
 	}.Render(KickUserStanza))
-	return nil
 }
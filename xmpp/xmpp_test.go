@@ -0,0 +1,198 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type fakeSocket struct {
+	inflight int32
+	overlap  int32
+
+	l    sync.Mutex
+	sent []string
+
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeSocket() *fakeSocket {
+	return &fakeSocket{
+		in:     make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeSocket) Send(b []byte) error {
+	if atomic.AddInt32(&f.inflight, 1) > 1 {
+		atomic.StoreInt32(&f.overlap, 1)
+	}
+	defer atomic.AddInt32(&f.inflight, -1)
+
+	f.l.Lock()
+	f.sent = append(f.sent, string(b))
+	f.l.Unlock()
+	return nil
+}
+
+func (f *fakeSocket) Recv() ([]byte, error) {
+	select {
+	case b := <-f.in:
+		return b, nil
+	case <-f.closed:
+		return nil, errors.New("socket closed")
+	}
+}
+
+func (f *fakeSocket) Close() {
+	f.once.Do(func() {
+		close(f.closed)
+	})
+}
+
+func (f *fakeSocket) count(substr string) int {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	n := 0
+	for _, v := range f.sent {
+		if strings.Contains(v, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConcurrentSend(t *testing.T) {
+	var tl sync.Mutex
+	var traced []string
+	tracer := TracerFunc(func(t Trace) {
+		if t.Direction == Outbound {
+			tl.Lock()
+			traced = append(traced, t.Stanza)
+			tl.Unlock()
+		}
+	})
+
+	sock := newFakeSocket()
+	c := newConn(sock, Opts{Host: "crypto.dog", SendQueueSize: 4, Tracer: tracer})
+	defer c.Disconnect()
+
+	const senders, each = 16, 50
+
+	// Pings are answered from the receiving goroutine while users are sending.
+	go func() {
+		for i := 0; i < each; i++ {
+			sock.in <- []byte(fmt.Sprintf(`<iq type='get' id='ping%d' xmlns='jabber:client'><ping xmlns='urn:xmpp:ping'/></iq>`, i))
+		}
+		sock.in <- []byte(`<presence from='lobby@conference.crypto.dog/bob'/>`)
+	}()
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if err := c.SendMessage("lobby@conference.crypto.dog", "groupchat", fmt.Sprintf("sender%d-%d", s, i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(s)
+	}
+
+	if _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	if atomic.LoadInt32(&sock.overlap) != 0 {
+		t.Fatal("socket was written to concurrently")
+	}
+
+	if n := sock.count("<body"); n != senders*each {
+		t.Fatal("expected", senders*each, "messages, got", n)
+	}
+
+	if n := sock.count("type='result'"); n != each {
+		t.Fatal("expected", each, "ping responses, got", n)
+	}
+
+	tl.Lock()
+	defer tl.Unlock()
+	sock.l.Lock()
+	defer sock.l.Unlock()
+	if strings.Join(traced, "\n") != strings.Join(sock.sent, "\n") {
+		t.Fatal("stanzas were traced in a different order than they were written")
+	}
+}
+
+func TestSendAfterDisconnect(t *testing.T) {
+	sock := newFakeSocket()
+	c := newConn(sock, Opts{Host: "crypto.dog"})
+
+	c.Disconnect()
+	c.Disconnect()
+
+	if err := c.SendMessage("lobby@conference.crypto.dog", "groupchat", "hi"); err != Closed {
+		t.Fatal("expected Closed, got", err)
+	}
+
+	if _, err := c.Recv(); err == nil {
+		t.Fatal("Recv should fail once the socket is closed")
+	}
+}
+
+func TestOversizedPolicy(t *testing.T) {
+	big := `<message from='lobby@conference.crypto.dog/bob' type='groupchat'><body>` + strings.Repeat("x", 200) + `</body></message>`
+
+	for _, tc := range []struct {
+		policy OversizedPolicy
+		err    error
+	}{
+		{DropOversized, nil},
+		{AcceptOversized, nil},
+		{DisconnectOversized, StanzaTooLarge},
+	} {
+		sock := newFakeSocket()
+		c := newConn(sock, Opts{Host: "crypto.dog", MaxStanzaSize: 100, OversizedPolicy: tc.policy})
+		sock.in <- []byte(big)
+
+		v, err := c.Recv()
+		if err != tc.err {
+			t.Fatal(tc.policy, "returned", err)
+		}
+
+		switch tc.policy {
+		case AcceptOversized:
+			if m, ok := v.(Message); !ok || len(m.Body) != 200 {
+				t.Fatalf("%d: expected the message, got %#v", tc.policy, v)
+			}
+		default:
+			if o, ok := v.(OversizedStanza); !ok || o.Size != len(big) || o.From != "lobby@conference.crypto.dog/bob" {
+				t.Fatalf("%d: expected an OversizedStanza, got %#v", tc.policy, v)
+			}
+		}
+
+		c.Disconnect()
+	}
+}
+
+func TestPeekFrom(t *testing.T) {
+	for _, v := range [][2]string{
+		{`<message to='a@crypto.dog' from='lobby@conference.crypto.dog/bob' type='groupchat'><body>x</body></message>`, "lobby@conference.crypto.dog/bob"},
+		{`<presence from="lobby@conference.crypto.dog/alice"/>`, "lobby@conference.crypto.dog/alice"},
+		{`<message to='a@crypto.dog'><body from='nope'/></message>`, ""},
+	} {
+		if from := peekFrom(v[0]); from != v[1] {
+			t.Fatal("Got", from, "should have been", v[1])
+		}
+	}
+}
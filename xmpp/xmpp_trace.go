@@ -0,0 +1,182 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+
+	return fmt.Sprintf("unknown direction (%d)", d)
+}
+
+func (d Direction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Trace is a single stanza as it crossed the wire.
+type Trace struct {
+	Direction Direction `json:"direction"`
+	Time      time.Time `json:"time"`
+	Stanza    string    `json:"stanza"`
+}
+
+// Tracer receives every stanza sent or received by a Conn. Implementations may be called from multiple goroutines at once.
+type Tracer interface {
+	Trace(t Trace)
+}
+
+// TracerFunc adapts an ordinary function to the Tracer interface.
+type TracerFunc func(Trace)
+
+func (f TracerFunc) Trace(t Trace) {
+	f(t)
+}
+
+type textTracer struct {
+	l sync.Mutex
+	w io.Writer
+}
+
+// TextTracer writes each stanza to w as a single human-readable line.
+func TextTracer(w io.Writer) Tracer {
+	return &textTracer{w: w}
+}
+
+func (t *textTracer) Trace(tr Trace) {
+	t.l.Lock()
+	fmt.Fprintf(t.w, "%s %-3s %s\n", tr.Time.Format(time.RFC3339Nano), tr.Direction, tr.Stanza)
+	t.l.Unlock()
+}
+
+// JSONTracer writes each stanza to its underlying writer as one JSON object per line.
+type JSONTracer struct {
+	l sync.Mutex
+	w io.Writer
+	e *json.Encoder
+}
+
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{
+		w: w,
+		e: json.NewEncoder(w),
+	}
+}
+
+// OpenJSONTracer appends JSON lines to the file at path, creating it if necessary.
+func OpenJSONTracer(path string) (*JSONTracer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJSONTracer(f), nil
+}
+
+func (j *JSONTracer) Trace(t Trace) {
+	j.l.Lock()
+	j.e.Encode(t)
+	j.l.Unlock()
+}
+
+// Close closes the underlying writer, if it is closable.
+func (j *JSONTracer) Close() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	if c, ok := j.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+const redacted = "[redacted]"
+
+var bodyRgx = regexp.MustCompile(`(?s)(<body[^>]*>)(.*?)(</body>)`)
+
+type redactor struct {
+	next Tracer
+}
+
+// Redact wraps a Tracer, masking multiparty ciphertext and OTR payloads in message bodies before passing stanzas on.
+// Public keys, key requests and stanza metadata are left intact.
+func Redact(t Tracer) Tracer {
+	return redactor{t}
+}
+
+func (r redactor) Trace(t Trace) {
+	t.Stanza = RedactStanza(t.Stanza)
+	r.next.Trace(t)
+}
+
+// RedactStanza returns a copy of stanza with encrypted message bodies masked.
+func RedactStanza(stanza string) string {
+	return bodyRgx.ReplaceAllStringFunc(stanza, func(s string) string {
+		m := bodyRgx.FindStringSubmatch(s)
+		body := redactBody(html.UnescapeString(m[2]))
+		return m[1] + html.EscapeString(body) + m[3]
+	})
+}
+
+func redactBody(body string) string {
+	if strings.HasPrefix(body, "?OTR") {
+		return fmt.Sprintf("?OTR%s (%d bytes)", redacted, len(body))
+	}
+
+	var mt map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &mt); err != nil {
+		return body
+	}
+
+	if mt["type"] != "message" {
+		return body
+	}
+
+	if _, ok := mt["tag"]; ok {
+		mt["tag"] = redacted
+	}
+
+	text, ok := mt["text"].(map[string]interface{})
+	if ok {
+		for _, v := range text {
+			ta, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			for _, field := range []string{"message", "iv", "hmac", "tag"} {
+				if _, ok := ta[field]; ok {
+					ta[field] = redacted
+				}
+			}
+		}
+	}
+
+	out, err := json.Marshal(mt)
+	if err != nil {
+		return redacted
+	}
+
+	return string(out)
+}
@@ -0,0 +1,82 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactStanza(t *testing.T) {
+	mp := Stanza{
+		Recipient: "lobby@conference.crypto.dog",
+		Type:      "groupchat",
+		JID:       "a@crypto.dog",
+		Body:      `{"type":"message","text":{"bob":{"message":"c2VjcmV0","iv":"aXY=","hmac":"aG1hYw=="}},"tag":"dGFn"}`,
+	}.Render(SendMessageStanza)
+
+	out := RedactStanza(mp)
+	for _, v := range []string{"c2VjcmV0", "aXY=", "aG1hYw==", "dGFn"} {
+		if strings.Contains(out, v) {
+			t.Fatal("ciphertext", v, "leaked into", out)
+		}
+	}
+
+	if !strings.Contains(out, "bob") {
+		t.Fatal("recipient list should survive redaction", out)
+	}
+
+	otr := Stanza{
+		Recipient: "lobby@conference.crypto.dog/bob",
+		Type:      "chat",
+		JID:       "a@crypto.dog",
+		Body:      "?OTR:AAMDsecretsecret.",
+	}.Render(SendMessageStanza)
+
+	if out := RedactStanza(otr); strings.Contains(out, "secretsecret") {
+		t.Fatal("OTR payload leaked into", out)
+	}
+
+	pk := Stanza{
+		Recipient: "lobby@conference.crypto.dog",
+		Type:      "groupchat",
+		JID:       "a@crypto.dog",
+		Body:      `{"type":"public_key","text":"cHVibGlj"}`,
+	}.Render(SendMessageStanza)
+
+	if out := RedactStanza(pk); out != pk {
+		t.Fatal("public key announcement should be untouched, got", out)
+	}
+
+	if out := RedactStanza("<message><body>unterminated"); out != "<message><body>unterminated" {
+		t.Fatal("malformed stanza was modified", out)
+	}
+}
+
+func TestJSONTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewJSONTracer(&buf)
+
+	now := time.Now()
+	tr.Trace(Trace{Inbound, now, "<iq/>"})
+	tr.Trace(Trace{Outbound, now, "<presence/>"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("expected 2 lines, got", len(lines))
+	}
+
+	var rec struct {
+		Direction string `json:"direction"`
+		Stanza    string `json:"stanza"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Direction != "out" || rec.Stanza != "<presence/>" {
+		t.Fatal("unexpected record", lines[1])
+	}
+}